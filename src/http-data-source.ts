@@ -1,68 +1,376 @@
 import { DataSource, DataSourceConfig } from 'apollo-datasource'
-import { Pool } from 'undici'
-import { STATUS_CODES } from 'http'
+import { Client, Pool, errors, getGlobalDispatcher } from 'undici'
+import { IncomingHttpHeaders, STATUS_CODES } from 'http'
 import QuickLRU from '@alloc/quick-lru'
 
-import { createUnzip, createBrotliDecompress } from 'zlib'
+import {
+  createUnzip,
+  createBrotliDecompress,
+  gzip as gzipCallback,
+  brotliCompress as brotliCompressCallback,
+} from 'zlib'
 import streamToPromise from 'stream-to-promise'
 import { KeyValueCache } from 'apollo-server-caching'
 import Dispatcher, { HttpMethod, ResponseData } from 'undici/types/dispatcher'
 import { toApolloError } from 'apollo-server-errors'
-import { EventEmitter } from 'stream'
+import { EventEmitter, Readable, Transform } from 'stream'
 import { Logger } from 'apollo-server-types'
-import { URLSearchParams } from 'url'
+import { URL, URLSearchParams } from 'url'
+import { createHash, randomBytes } from 'crypto'
+import { promisify } from 'util'
+import { performance } from 'perf_hooks'
 
 type AbortSignal = unknown
 
+// diagnostics_channel is available since Node.js 14.17 and 15.1
+let diagnosticsChannel: typeof import('diagnostics_channel') | undefined
+try {
+  diagnosticsChannel = require('diagnostics_channel')
+} catch {
+  diagnosticsChannel = undefined
+}
+
+const gzip = promisify(gzipCallback)
+const brotliCompress = promisify(brotliCompressCallback)
+
 export class RequestError<T = unknown> extends Error {
+  // The number of attempts which were made including retries
+  public attempt = 1
+
   constructor(
     public message: string,
+    // The status code of the response or 0 when no response was received
     public code: number,
     public request: Request,
-    public response: Response<T>,
+    public response?: Response<T>,
+    // The original error e.g a network error of undici
+    public cause?: Error,
   ) {
     super(message)
     this.name = 'RequestError'
   }
+
+  get statusCode(): number {
+    return this.code
+  }
+
+  get body(): T | undefined {
+    return this.response?.body
+  }
+}
+
+export class RequestAbortedError extends RequestError<never> {
+  constructor(message: string, request: Request) {
+    super(message, 0, request)
+    this.name = 'RequestAbortedError'
+  }
+}
+
+export class RequestTimeoutError extends RequestError<never> {
+  constructor(
+    message: string,
+    // Indicates which undici timeout was exceeded
+    public timeout: 'headers' | 'body',
+    request: Request,
+  ) {
+    super(message, 0, request)
+    this.name = 'RequestTimeoutError'
+  }
+}
+
+export class TooManyRedirectsError extends RequestError<never> {
+  constructor(message: string, code: number, request: Request) {
+    super(message, code, request)
+    this.name = 'TooManyRedirectsError'
+  }
+}
+
+export class ResponseTooLargeError extends RequestError<never> {
+  constructor(
+    message: string,
+    // The exceeded limit in bytes
+    public maxResponseSize: number,
+    code: number,
+    request: Request,
+  ) {
+    super(message, code, request)
+    this.name = 'ResponseTooLargeError'
+  }
+}
+
+export class PoolExhaustedError extends RequestError<never> {
+  constructor(
+    message: string,
+    // The exceeded number of queued requests of the pool
+    public maxQueuedRequests: number,
+    request: Request,
+  ) {
+    super(message, 0, request)
+    this.name = 'PoolExhaustedError'
+  }
+}
+
+export class DataSourceClosedError extends Error {
+  constructor(message: string) {
+    super(message)
+    this.name = 'DataSourceClosedError'
+  }
 }
 
 export type CacheTTLOptions = {
   requestCache?: {
-    // The maximum time an item is cached in seconds.
-    maxTtl: number
+    // The maximum time an item is cached in seconds. A function decides by the response
+    // e.g its status code, by returning false the response is neither memoized nor cached.
+    maxTtl: number | ((response: Response<unknown>) => number | false)
     // The maximum time the cache should be used when the re-fetch from the origin fails.
     maxTtlIfError: number
+    // The time in seconds a stale item is served after maxTtl while it's refreshed in background.
+    swr?: number
+    // Respond with the stale item when the request fails. Default: true
+    serveStaleOnError?: boolean
+    // Prepended to the cache key, takes precedence over the cacheKeyPrefix of the datasource
+    keyPrefix?: string
+    // Revalidate an expired item with its ETag or Last-Modified header. Default: false
+    // The validators are kept for maxTtlIfError after maxTtl.
+    revalidate?: boolean
   }
 }
 
+// The request cache options with the ttl of the response
+type ResolvedRequestCache = Omit<NonNullable<CacheTTLOptions['requestCache']>, 'maxTtl'> & {
+  maxTtl: number
+}
+
 interface Dictionary<T> {
   [Key: string]: T | undefined
 }
 
+// Determines how the response body is parsed
+// json: parsed as JSON, the response must have a JSON content-type
+// text: passed as utf-8 string
+// arraybuffer: passed as Buffer, the body is stored base64 encoded in the request cache
+// stream: passed as the readable of undici, the response is never memoized or cached. See stream()
+export type ResponseType = 'json' | 'text' | 'arraybuffer' | 'stream'
+
+export type RetryOptions = {
+  // The maximum number of retries after the initial attempt
+  maxRetries: number
+  // The delay in milliseconds before the first retry. The delay is doubled for every further retry.
+  delay?: number
+  // Randomizes the delay to spread the retries of concurrent requests. Default: full
+  // full: between 0 and the delay, equal: between the half of the delay and the delay
+  jitter?: 'none' | 'full' | 'equal'
+  // The maximum Retry-After (milliseconds) of a 429 or 503 response which is waited for before
+  // retrying, a longer Retry-After is capped. Default: 60000
+  maxRetryAfter?: number
+  // Retry a request which was rejected because the queue of the pool was full. Default: false
+  retryOnPoolExhausted?: boolean
+  // Unsuccessful responses with these status codes are retried.
+  // Default: 408, 429, 500, 502, 503, 504
+  retryableStatusCodes?: number[]
+  // Decides if the failed attempt (starting at 1) is retried.
+  // Takes precedence over retryableStatusCodes.
+  shouldRetry?: (error: Error, request: Request, attempt: number) => boolean
+}
+
+export type QueryValue =
+  | string
+  | number
+  | boolean
+  | null
+  | QueryValue[]
+  | { [key: string]: QueryValue | undefined }
+
+// Determines how arrays in the query are serialized
+// repeat: ids=1&ids=2
+// comma: ids=1,2
+// brackets: ids[]=1&ids[]=2
+// A function receives the query and returns the query string without the leading "?".
+export type QuerySerializer =
+  | 'repeat'
+  | 'comma'
+  | 'brackets'
+  | ((query: Dictionary<QueryValue>) => string)
+
+// A subset of the OpenTelemetry Span interface
+export interface Span {
+  spanContext(): { traceId: string; spanId: string; traceFlags: number }
+  setAttribute(key: string, value: string | number | boolean): unknown
+  recordException(exception: Error): void
+  setStatus(status: { code: number; message?: string }): unknown
+  end(): void
+}
+
+// A subset of the OpenTelemetry Tracer interface
+export interface Tracer {
+  startSpan(
+    name: string,
+    options?: { kind?: number; attributes?: Dictionary<string | number | boolean> },
+  ): Span
+}
+
 export type RequestOptions = Omit<Partial<Request>, 'origin' | 'path' | 'method'>
 
 export type Request<T = unknown> = {
+  // Passed unchanged to the hooks e.g a request id or the locale, it's never sent to the upstream
+  // or stored in the cache. Merged with the context of the global requestOptions.
   context: Dictionary<string>
-  query: Dictionary<string | number>
+  query: Dictionary<QueryValue>
+  querySerializer?: QuerySerializer
+  // Values of the :name placeholders of the path, the values are URL-encoded
+  params?: Dictionary<string | number>
   body: T
   signal?: AbortSignal | EventEmitter | null
   json?: boolean
+  responseType?: ResponseType
+  // Retries failed requests. Requests aren't retried by default.
+  retry?: RetryOptions
+  // The span of the request when a tracer is configured
+  span?: Span
+  // The maximum number of redirects which are followed. Default: 0
+  maxRedirects?: number
+  // Keep the authorization, proxy-authorization and cookie headers on redirects to another
+  // origin. Default: false
+  keepAuthorizationOnRedirect?: boolean
+  // The maximum size in bytes of the response body, overrides the option of the datasource
+  maxResponseSize?: number
+  // The maximum size in bytes of the compressed body, overrides the option of the datasource
+  maxCompressedResponseSize?: number
+  // Decompress the response body according to the content-encoding header. Default: true
+  decompress?: boolean
+  // Decides if a response is successful, unsuccessful responses are thrown as RequestError.
+  // Takes precedence over isResponseOk of the datasource. Default: 200 - 399
+  validateStatus?: (statusCode: number) => boolean
+  // Compresses the request body and sets the content-encoding header
+  compression?: 'gzip' | 'br'
+  // The minimum size in bytes of the request body to be compressed. Default: 1024
+  compressionThreshold?: number
   origin: string
   path: string
   method: HttpMethod
   // Indicates if the response of this request should be memoized
   memoize?: boolean
   headers: Dictionary<string>
+  // Overrides the headersTimeout and bodyTimeout (milliseconds) of the client for this request
+  timeouts?: {
+    headers?: number
+    body?: number
+  }
 } & CacheTTLOptions
 
 export type Response<TResult> = {
   body: TResult
   memoized: boolean
   isFromCache: boolean
+  // The url of the response after redirects
+  url?: string
+  // The timings of the request when collectTimings is enabled
+  timings?: Timings
+  // Indicates that the cached response has exceeded maxTtl
+  isStale?: boolean
   // maximum ttl (seconds)
   maxTtl?: number
+  // The headers as flat list of names and values as received, duplicate headers e.g set-cookie
+  // are repeated and the names keep their casing
+  rawHeaders?: string[]
 } & Omit<ResponseData, 'body'>
 
+export interface Timings {
+  // The time in milliseconds the request waited for a connection of the pool including the connect
+  queued?: number
+  // The time in milliseconds to establish the connection the request waited for
+  connect?: number
+  // The time in milliseconds from sending the request until the response headers were received
+  ttfb?: number
+  // The time in milliseconds to receive the response body
+  download?: number
+  // The time in milliseconds of all attempts including the retry delays
+  total: number
+  // The number of retries
+  retryCount: number
+  // Indicates that the response was served from the memoization or the request cache
+  fromCache: boolean
+}
+
+// Points in time (performance.now) of an attempt
+interface AttemptTimings {
+  start: number
+  sent?: number
+  headers?: number
+  // the duration of the connect
+  connect?: number
+}
+
+// Identifies the cache layer which was consulted for a request
+// memoize: the per datasource instance LRU cache
+// requestCache: the shared KeyValueCache
+export type CacheSource = 'memoize' | 'requestCache'
+
+// A file of a multipart body e.g a Blob or File
+export interface FormDataFile {
+  readonly type: string
+  readonly name?: string
+  arrayBuffer(): Promise<ArrayBuffer>
+}
+
+// A WHATWG FormData e.g the global FormData of Node.js 18 or of the formdata-node package
+export interface FormDataLike {
+  readonly [Symbol.toStringTag]: string
+  entries(): IterableIterator<[string, string | FormDataFile]>
+}
+
+export interface RedactOptions {
+  // Names of request and response headers which are masked.
+  // Default: authorization, cookie, set-cookie
+  headers?: string[]
+  // Dot separated paths of JSON body fields which are masked e.g user.password or items.*.token
+  bodyPaths?: string[]
+}
+
+export type BatchRequest = {
+  method: 'GET' | 'HEAD' | 'POST' | 'PUT' | 'PATCH' | 'DELETE'
+  path: string
+  options?: RequestOptions
+}
+
+export interface BatchOptions {
+  // The maximum number of requests in flight. Default: unlimited
+  concurrency?: number
+  // Execute all requests and respond with their settled results instead of rejecting
+  // on the first failure. Default: false
+  settle?: boolean
+}
+
+// A cookie store e.g the CookieJar of tough-cookie
+export interface CookieJar {
+  // Returns the cookie header of the cookies which match the url
+  getCookieString(url: string): Promise<string>
+  // Stores the set-cookie header of a response from the url
+  setCookie(cookie: string, url: string): Promise<unknown>
+}
+
+export interface AuthProvider {
+  // Returns the bearer token for the authorization header
+  getToken(): Promise<string>
+  // Returns a new bearer token after the upstream responded with 401
+  refreshToken?(): Promise<string>
+}
+
+export interface PoolStats {
+  // Number of open socket connections
+  readonly connected: number
+  // Number of open socket connections which are not processing a request
+  readonly free: number
+  // Number of pending requests across all clients
+  readonly pending: number
+  // Number of queued requests across all clients
+  readonly queued: number
+  // Number of currently active requests across all clients
+  readonly running: number
+  // Number of active, pending, or queued requests across all clients
+  readonly size: number
+}
+
 export interface LRUOptions {
   readonly maxAge?: number
   readonly maxSize: number
@@ -71,9 +379,54 @@ export interface LRUOptions {
 export interface HTTPDataSourceOptions {
   logger?: Logger
   pool?: Pool
+  // Any undici dispatcher e.g ProxyAgent or Agent. Takes precedence over pool.
+  dispatcher?: Dispatcher
+  // The pools by origin of the base urls resolved by resolveBaseURL, missing pools are added.
+  // Share the map across datasource instances to reuse the connections.
+  pools?: Map<string, Pool>
   requestOptions?: RequestOptions
+  // Options of the pools created by the datasource e.g connections, pipelining and keep-alive.
+  // They don't apply to the pool or dispatcher passed as option.
   clientOptions?: Pool.Options
+  // Options of the LRU cache which memoizes the responses of a datasource instance
   lru?: Partial<LRUOptions>
+  // Memoize the responses of a datasource instance, set to false to disable it. Default: true
+  memoizeGetRequests?: boolean
+  // The default query serializer, can be overridden per request. Default: repeat
+  querySerializer?: QuerySerializer
+  // Cache GET responses according to their Cache-Control and Expires headers. Default: false
+  respectCacheControl?: boolean
+  // Creates a span for every request e.g the tracer of @opentelemetry/api
+  tracer?: Tracer
+  // Sets the authorization header of requests which don't provide one
+  authProvider?: AuthProvider
+  // Prepended to the cache key of every request e.g to isolate the cache items of tenants
+  cacheKeyPrefix?: string
+  // Parses response bodies and cache items e.g with a bigint-safe parser. Default: JSON.parse
+  jsonParse?: (text: string) => unknown
+  // Serializes JSON request bodies and cache items. Default: JSON.stringify
+  jsonStringify?: (value: unknown) => string
+  // Masks sensitive data of the request and response attached to errors and passed to onError
+  redact?: RedactOptions
+  // Stores the cookies of responses and sends them with the requests to the same site
+  cookieJar?: CookieJar
+  // The maximum size in bytes of the (decompressed) response body. Default: unlimited
+  maxResponseSize?: number
+  // The maximum size in bytes of the compressed response body. Default: unlimited
+  maxCompressedResponseSize?: number
+  // Decompress gzip, deflate and br response bodies, can be overridden per request. Default: true
+  decompress?: boolean
+  // Attach the timings of a request to the response. Default: false
+  collectTimings?: boolean
+  // Headers of every request, the headers of the request take precedence
+  defaultHeaders?: Dictionary<string> | ((request: Request) => Dictionary<string>)
+  // Reject requests with a PoolExhaustedError instead of queueing them when the number of
+  // requests which wait for a connection of the pool reaches the limit. Requires limited
+  // clientOptions.connections, the pool doesn't queue requests otherwise. Default: unlimited
+  maxQueuedRequests?: number
+  // Identical GET requests of all datasource instances which are started within the window
+  // (milliseconds) share the response of the request in flight. Default: disabled
+  dedupeWindowMs?: number
 }
 
 // rfc7231 6.1
@@ -81,17 +434,361 @@ export interface HTTPDataSourceOptions {
 // We don't cache redirects, client errors because we expect to cache JSON payload.
 const statusCodeCacheableByDefault = new Set([200, 203])
 
+// rfc7231 6.4, rfc7538
+const redirectStatusCodes = new Set([301, 302, 303, 307, 308])
+
+const redacted = '***'
+const defaultRedactedHeaders = ['authorization', 'cookie', 'set-cookie']
+
+// Too Many Requests and Service Unavailable responses announce when to retry with Retry-After
+const retryAfterStatusCodes = new Set([429, 503])
+
+// The headers which are dropped on redirects to another origin, the cookies of the cookieJar
+// are matched with the url of the redirect
+const credentialHeaders = ['authorization', 'proxy-authorization', 'cookie']
+
+// The headers of tracing which are set by the datasource and are ignored to dedupe requests
+const dedupeIgnoredHeaders = ['traceparent']
+
+// A placeholder of a path parameter at the start of a segment e.g /users/:id
+const pathParamPattern = /\/:([A-Za-z_]\w*)/g
+
+// The timings of the attempts of requests
+const attemptTimings = new WeakMap<object, AttemptTimings>()
+// The raw headers of the responses of undici
+const responseRawHeaders = new WeakMap<ResponseData, string[]>()
+// The timings of the attempt whose request is written to a socket at the moment
+let sendingTimings: AttemptTimings | undefined
+// The start of the pending connects by connector and the connects by socket
+const pendingConnects = new WeakMap<object, number>()
+const socketConnects = new WeakMap<object, { start: number; end: number }>()
+let timingChannels: unknown[] | undefined
+
+/**
+ * Subscribes to the diagnostics channels of undici to measure the connects of the sockets.
+ * The headers of a request are sent synchronously after its handler was connected,
+ * which is how the socket is associated with the timings of the attempt.
+ */
+function subscribeTimingChannels() {
+  if (timingChannels || !diagnosticsChannel) {
+    return
+  }
+
+  // the channels are held weakly by older Node.js versions
+  const beforeConnect = diagnosticsChannel.channel('undici:client:beforeConnect')
+  const connected = diagnosticsChannel.channel('undici:client:connected')
+  const sendHeaders = diagnosticsChannel.channel('undici:client:sendHeaders')
+  timingChannels = [beforeConnect, connected, sendHeaders]
+
+  beforeConnect.subscribe((message: any) => {
+    pendingConnects.set(message.connector, performance.now())
+  })
+  connected.subscribe((message: any) => {
+    const start = pendingConnects.get(message.connector)
+    if (start !== undefined) {
+      socketConnects.set(message.socket, { start, end: performance.now() })
+    }
+  })
+  sendHeaders.subscribe((message: any) => {
+    const timings = sendingTimings
+    sendingTimings = undefined
+    const connect = socketConnects.get(message.socket)
+    // the attempt waited for the connection
+    if (timings && connect && connect.end >= timings.start) {
+      timings.connect = connect.end - Math.max(connect.start, timings.start)
+    }
+  })
+}
+
+/**
+ * Wraps the dispatch handler of an undici request to keep the raw headers of the response and
+ * to record when the request was sent and the response headers were received. The pool may
+ * queue the request before.
+ */
+class AttemptHandler implements Dispatcher.DispatchHandlers {
+  constructor(
+    private handler: Dispatcher.DispatchHandlers,
+    private rawHeaders: string[],
+    private timings?: AttemptTimings,
+  ) {}
+
+  onConnect(abort: () => void): void {
+    const timings = this.timings
+    if (timings) {
+      timings.sent = performance.now()
+      sendingTimings = timings
+      // the headers aren't sent when the request was aborted
+      queueMicrotask(() => {
+        if (sendingTimings === timings) {
+          sendingTimings = undefined
+        }
+      })
+    }
+    this.handler.onConnect?.(abort)
+  }
+
+  onHeaders(...args: Parameters<NonNullable<Dispatcher.DispatchHandlers['onHeaders']>>): boolean {
+    if (this.timings) {
+      this.timings.headers = performance.now()
+    }
+    // undici passes the headers as buffers
+    for (const item of args[1] ?? []) {
+      this.rawHeaders.push(item.toString())
+    }
+    return this.handler.onHeaders?.(...args) ?? true
+  }
+
+  onData(chunk: Buffer): boolean {
+    return this.handler.onData?.(chunk) ?? true
+  }
+
+  onComplete(trailers: string[] | null): void {
+    this.handler.onComplete?.(trailers)
+  }
+
+  onError(err: Error): void {
+    this.handler.onError?.(err)
+  }
+
+  onUpgrade(...args: Parameters<NonNullable<Dispatcher.DispatchHandlers['onUpgrade']>>): void {
+    this.handler.onUpgrade?.(...args)
+  }
+
+  onBodySent(...args: unknown[]): void {
+    const handler: { onBodySent?(...args: unknown[]): void } = this.handler
+    handler.onBodySent?.(...args)
+  }
+}
+
+// SpanKind.CLIENT and SpanStatusCode.ERROR of @opentelemetry/api
+const spanKindClient = 2
+const spanStatusCodeError = 2
+
+// rfc7231 6.5.7, 6.6
+// Status codes which indicate a transient error of the origin
+const defaultRetryableStatusCodes = [408, 429, 500, 502, 503, 504]
+
+// The following state is shared across datasource instances because an instance is scoped to a
+// single graphql request.
+
+// Pending token refreshes of auth providers
+const tokenRefreshes = new WeakMap<AuthProvider, Promise<string>>()
+
+// Cache keys which are currently refreshed in the background
+const backgroundRevalidations = new Set<string>()
+
+// GET requests in flight by datasource class and request which are joined by identical requests
+// within dedupeWindowMs
+const sharedRequests = new WeakMap<object, Map<string, Promise<Response<any>>>>()
+
+/**
+ * Copies plain objects and arrays with sorted object keys so that equivalent objects are
+ * serialized to the same string. Any other value e.g a Date is kept as is.
+ */
+function sortKeys(value: unknown): unknown {
+  if (Array.isArray(value)) {
+    return value.map(sortKeys)
+  }
+  if (value === null || typeof value !== 'object') {
+    return value
+  }
+  const prototype = Object.getPrototypeOf(value)
+  if (prototype !== Object.prototype && prototype !== null) {
+    return value
+  }
+  const sorted: Dictionary<unknown> = {}
+  for (const key of Object.keys(value).sort()) {
+    sorted[key] = sortKeys((value as Dictionary<unknown>)[key])
+  }
+  return sorted
+}
+
+/**
+ * Merges the headers, later headers take precedence. Header names are compared
+ * case-insensitively and the name of the winning header is kept as is.
+ */
+function mergeHeaders(...headersList: Array<Dictionary<string> | undefined>): Dictionary<string> {
+  const merged: Dictionary<string> = {}
+  const names = new Map<string, string>()
+  for (const headers of headersList) {
+    if (headers) {
+      for (const name of Object.keys(headers)) {
+        const previousName = names.get(name.toLowerCase())
+        if (previousName !== undefined) {
+          delete merged[previousName]
+        }
+        names.set(name.toLowerCase(), name)
+        merged[name] = headers[name]
+      }
+    }
+  }
+  return merged
+}
+
+// Returns the name of the header regardless of its case
+function findHeaderName(headers: Dictionary<string>, name: string): string | undefined {
+  return Object.keys(headers).find((key) => key.toLowerCase() === name)
+}
+
+// Deletes the header regardless of the case of its name
+function deleteHeader(headers: Dictionary<string>, name: string): void {
+  for (const key of Object.keys(headers)) {
+    if (key.toLowerCase() === name) {
+      delete headers[key]
+    }
+  }
+}
+
+function isFormData(body: unknown): body is FormDataLike {
+  return (
+    body !== null &&
+    typeof body === 'object' &&
+    (body as FormDataLike)[Symbol.toStringTag] === 'FormData' &&
+    typeof (body as FormDataLike).entries === 'function'
+  )
+}
+
+// rfc7578, names are escaped like browsers do
+function escapeFormDataName(name: string): string {
+  return name.replace(/\n/g, '%0A').replace(/\r/g, '%0D').replace(/"/g, '%22')
+}
+
+/**
+ * Serializes the form to a multipart/form-data body. The body is a buffer
+ * so that it can be sent again when the request is retried.
+ */
+async function serializeFormData(form: FormDataLike, boundary: string): Promise<Buffer> {
+  const chunks: Buffer[] = []
+  for (const [name, value] of form.entries()) {
+    let disposition = `form-data; name="${escapeFormDataName(name)}"`
+    if (typeof value === 'string') {
+      chunks.push(
+        Buffer.from(`--${boundary}\r\nContent-Disposition: ${disposition}\r\n\r\n${value}\r\n`),
+      )
+      continue
+    }
+    disposition += `; filename="${escapeFormDataName(value.name ?? 'blob')}"`
+    const contentType = value.type || 'application/octet-stream'
+    chunks.push(
+      Buffer.from(`--${boundary}\r\nContent-Disposition: ${disposition}\r\n`),
+      Buffer.from(`Content-Type: ${contentType}\r\n\r\n`),
+      Buffer.from(await value.arrayBuffer()),
+      Buffer.from('\r\n'),
+    )
+  }
+  chunks.push(Buffer.from(`--${boundary}--\r\n`))
+  return Buffer.concat(chunks)
+}
+
+/**
+ * Returns a copy of the headers in which the values of the names are masked.
+ */
+function redactHeaders<T extends object>(headers: T, names: string[]): T {
+  const copy: Dictionary<unknown> = { ...headers }
+  for (const name of Object.keys(copy)) {
+    if (names.includes(name.toLowerCase())) {
+      copy[name] = redacted
+    }
+  }
+  return copy as T
+}
+
+/**
+ * Returns a copy of the value in which the field of the path is masked.
+ * Only the objects along the path are copied. A * matches every item of an array or object.
+ */
+function redactPath(value: unknown, path: string[]): unknown {
+  // only JSON values are redacted, not e.g buffers or streams
+  if (
+    value === null ||
+    typeof value !== 'object' ||
+    !(Array.isArray(value) || Object.getPrototypeOf(value) === Object.prototype) ||
+    path.length === 0
+  ) {
+    return value
+  }
+
+  const copy: Dictionary<unknown> = Array.isArray(value) ? [...value] : { ...value }
+  const [key, ...rest] = path
+  for (const name of key === '*' ? Object.keys(copy) : [key]) {
+    if (name in copy) {
+      copy[name] = rest.length === 0 ? redacted : redactPath(copy[name], rest)
+    }
+  }
+  return copy
+}
+
+/**
+ * Parses the Retry-After header (seconds or a http date) of a response.
+ *
+ * @returns the delay in milliseconds or *undefined* if no valid header was provided
+ */
+function getRetryAfter(headers: IncomingHttpHeaders): number | undefined {
+  const retryAfter = headers['retry-after']
+  if (!retryAfter) {
+    return undefined
+  }
+  if (/^\d+$/.test(retryAfter)) {
+    return Number(retryAfter) * 1000
+  }
+  const date = Date.parse(retryAfter)
+  return Number.isNaN(date) ? undefined : Math.max(0, date - Date.now())
+}
+
+/**
+ * Derives the ttl (seconds) from the Cache-Control or Expires header of a response.
+ * s-maxage takes precedence over max-age and both take precedence over Expires.
+ *
+ * @returns *false* if the response must not be cached or *undefined* if no ttl was provided
+ */
+function getCacheControlTtl(headers: IncomingHttpHeaders): number | false | undefined {
+  const cacheControl = headers['cache-control']
+  if (cacheControl) {
+    const directives = new Map<string, string | undefined>()
+    for (const directive of cacheControl.split(',')) {
+      const [name, value] = directive.trim().toLowerCase().split('=')
+      directives.set(name, value)
+    }
+
+    if (directives.has('no-store') || directives.has('no-cache') || directives.has('private')) {
+      return false
+    }
+
+    const maxAge = directives.get('s-maxage') ?? directives.get('max-age')
+    if (maxAge !== undefined) {
+      const ttl = parseInt(maxAge, 10)
+      if (Number.isNaN(ttl)) {
+        return undefined
+      }
+      return ttl > 0 ? ttl : false
+    }
+  }
+
+  const expires = headers['expires']
+  if (expires) {
+    const ttl = Math.floor((Date.parse(expires) - Date.now()) / 1000)
+    // an invalid date represents a time in the past
+    return ttl > 0 ? ttl : false
+  }
+
+  return undefined
+}
+
 /**
  * HTTPDataSource is an optimized HTTP Data Source for Apollo Server
  * It focus on reliability and performance.
  */
 export abstract class HTTPDataSource<TContext = any> extends DataSource {
   public context!: TContext
-  private pool: Pool
+  private dispatcher: Dispatcher
   private logger?: Logger
   private cache!: KeyValueCache<string>
   private globalRequestOptions?: RequestOptions
   private readonly memoizedResults: QuickLRU<string, Response<any>>
+  private readonly inflightRequests = new Map<string, Promise<Response<any>>>()
+  private readonly prefetches = new WeakMap<Request, { stored: boolean }>()
+  private readonly pools: Map<string, Pool>
+  private closed = false
 
   constructor(public readonly baseURL: string, private readonly options?: HTTPDataSourceOptions) {
     super()
@@ -102,19 +799,143 @@ export abstract class HTTPDataSource<TContext = any> extends DataSource {
       // By default maxAge will be Infinity, which means that items will never expire.
       maxAge: this.options?.lru?.maxAge,
     })
-    this.pool = options?.pool ?? new Pool(this.baseURL, options?.clientOptions)
+    if (
+      options?.maxQueuedRequests !== undefined &&
+      !options.dispatcher &&
+      !options.pool &&
+      !options.clientOptions?.connections
+    ) {
+      throw new Error('maxQueuedRequests requires limited clientOptions.connections')
+    }
+    this.dispatcher =
+      options?.dispatcher ?? options?.pool ?? new Pool(this.baseURL, options?.clientOptions)
+    this.pools = options?.pools ?? new Map()
     this.globalRequestOptions = options?.requestOptions
     this.logger = options?.logger
+    if (options?.collectTimings) {
+      subscribeTimingChannels()
+    }
+  }
+
+  private parseJSON<T = any>(text: string): T {
+    return (this.options?.jsonParse ?? JSON.parse)(text) as T
+  }
+
+  private stringifyJSON(value: unknown): string {
+    return (this.options?.jsonStringify ?? JSON.stringify)(value)
+  }
+
+  /**
+   * Serializes the response as cache item. A binary body is encoded as base64 because JSON
+   * would corrupt it.
+   */
+  private stringifyCacheItem(response: Response<unknown>): string {
+    if (Buffer.isBuffer(response.body)) {
+      return this.stringifyJSON({
+        ...response,
+        body: response.body.toString('base64'),
+        bodyEncoding: 'base64',
+      })
+    }
+    return this.stringifyJSON(response)
+  }
+
+  private parseCacheItem<TResult>(cacheItem: string): Response<TResult> {
+    const { bodyEncoding, ...response } = this.parseJSON(cacheItem)
+    if (bodyEncoding === 'base64') {
+      response.body = Buffer.from(response.body, 'base64')
+    }
+    return response
+  }
+
+  private redactBody(body: unknown): unknown {
+    const bodyPaths = this.options?.redact?.bodyPaths ?? []
+    if (bodyPaths.length === 0) {
+      return body
+    }
+
+    // JSON bodies of requests are already serialized
+    let value = body
+    if (typeof body === 'string') {
+      try {
+        value = this.parseJSON(body)
+      } catch {
+        return body
+      }
+    }
+    for (const path of bodyPaths) {
+      value = redactPath(value, path.split('.'))
+    }
+    return typeof body === 'string' ? this.stringifyJSON(value) : value
+  }
+
+  private get redactedHeaders(): string[] {
+    return (this.options?.redact?.headers ?? defaultRedactedHeaders).map((name) =>
+      name.toLowerCase(),
+    )
+  }
+
+  private redactRequest(request: Request): Request {
+    return {
+      ...request,
+      headers: redactHeaders(request.headers, this.redactedHeaders),
+      body: this.redactBody(request.body),
+    }
+  }
+
+  private redactResponse<T>(response: Response<T>): Response<T> {
+    const headerNames = this.redactedHeaders
+    return {
+      ...response,
+      headers: redactHeaders(response.headers, headerNames),
+      rawHeaders: response.rawHeaders?.map((item, i, rawHeaders) =>
+        i % 2 === 1 && headerNames.includes(rawHeaders[i - 1].toLowerCase()) ? redacted : item,
+      ),
+      body: this.redactBody(response.body) as T,
+    }
   }
 
-  private buildQueryString(query: Dictionary<string | number>): string {
+  private buildQueryString(query: Dictionary<QueryValue>, serializer: QuerySerializer): string {
+    if (typeof serializer === 'function') {
+      return serializer(query)
+    }
+
     const params = new URLSearchParams()
+    const append = (key: string, value: QueryValue | undefined) => {
+      if (value === undefined || value === null) {
+        return
+      }
+
+      if (Array.isArray(value)) {
+        const values = value.filter((item) => item !== undefined && item !== null)
+        if (serializer === 'comma') {
+          if (values.length > 0) {
+            params.append(key, values.join(','))
+          }
+          return
+        }
+        for (const item of values) {
+          append(serializer === 'brackets' ? `${key}[]` : key, item)
+        }
+        return
+      }
+
+      // nested objects are always serialized in bracket notation e.g filter[status]=active
+      if (typeof value === 'object') {
+        for (const nestedKey in value) {
+          if (Object.prototype.hasOwnProperty.call(value, nestedKey)) {
+            append(`${key}[${nestedKey}]`, value[nestedKey])
+          }
+        }
+        return
+      }
+
+      params.append(key, value.toString())
+    }
+
     for (const key in query) {
       if (Object.prototype.hasOwnProperty.call(query, key)) {
-        const value = query[key]
-        if (value !== undefined) {
-          params.append(key, value.toString())
-        }
+        append(key, query[key])
       }
     }
 
@@ -124,6 +945,48 @@ export abstract class HTTPDataSource<TContext = any> extends DataSource {
     return params.toString()
   }
 
+  /**
+   * Closes the pools which were created by the datasource. A pool, dispatcher or pools map
+   * passed as option is left open as it's managed by the caller. Running requests are
+   * completed, further requests reject with a DataSourceClosedError.
+   */
+  public async close(): Promise<void> {
+    if (this.closed) {
+      return
+    }
+    this.closed = true
+
+    const pools: Dispatcher[] = []
+    if (!this.options?.dispatcher && !this.options?.pool) {
+      pools.push(this.dispatcher)
+    }
+    if (!this.options?.pools) {
+      pools.push(...this.pools.values())
+      this.pools.clear()
+    }
+    await Promise.all(pools.map((pool) => pool.close()))
+  }
+
+  /**
+   * Returns the connection statistics of the pool or *undefined* when the dispatcher
+   * doesn't provide statistics e.g an Agent.
+   */
+  get stats(): PoolStats | undefined {
+    const stats = (this.dispatcher as Partial<Pool>).stats
+    if (!stats) {
+      return undefined
+    }
+
+    return {
+      connected: stats.connected,
+      free: stats.free,
+      pending: stats.pending,
+      queued: stats.queued,
+      running: stats.running,
+      size: stats.size,
+    }
+  }
+
   /**
    * Initialize the datasource with apollo internals (context, cache).
    *
@@ -138,11 +1001,29 @@ export abstract class HTTPDataSource<TContext = any> extends DataSource {
     return statusCode >= 200 && statusCode <= 399
   }
 
+  private isStatusValid(request: Request, statusCode: number): boolean {
+    return request.validateStatus
+      ? request.validateStatus(statusCode)
+      : this.isResponseOk(statusCode)
+  }
+
+  /**
+   * Checks if the response is cacheable. By default only 200 and 203 responses are cached
+   * unless a **maxTtl** function decides by the response. Redirects are never cached.
+   * @param request
+   * @param response
+   * @returns *true* if the response should be cached
+   */
   protected isResponseCacheable<TResult = unknown>(
     request: Request,
     response: Response<TResult>,
   ): boolean {
-    return statusCodeCacheableByDefault.has(response.statusCode) && this.isRequestCacheable(request)
+    const isRedirect = response.statusCode >= 300 && response.statusCode <= 399
+    return (
+      ((typeof request.requestCache?.maxTtl === 'function' && !isRedirect) ||
+        statusCodeCacheableByDefault.has(response.statusCode)) &&
+      this.isRequestCacheable(request)
+    )
   }
 
   protected isRequestCacheable(request: Request): boolean {
@@ -152,24 +1033,67 @@ export abstract class HTTPDataSource<TContext = any> extends DataSource {
   }
 
   /**
-   * Checks if the GET request is memoizable. This validation is performed before the
-   * response is set in **memoizedResults**.
+   * Checks if the GET, HEAD or POST request is memoizable. This validation is performed before
+   * the response is set in **memoizedResults**. POST requests are only memoized when **memoize**
+   * is set. No request is memoized when **memoizeGetRequests** of the datasource is disabled.
+   * A FormData body has no stable representation for the key and is never memoized.
    * @param request
    * @returns *true* if request should be memoized
    */
   protected isRequestMemoizable(request: Request): boolean {
-    return Boolean(request.memoize) && request.method === 'GET'
+    return (
+      this.options?.memoizeGetRequests !== false &&
+      request.responseType !== 'stream' &&
+      !isFormData(request.body) &&
+      Boolean(request.memoize) &&
+      (request.method === 'GET' || request.method === 'HEAD' || request.method === 'POST')
+    )
+  }
+
+  private getCacheKeyPrefix(request: Request): string {
+    return request.requestCache?.keyPrefix ?? this.options?.cacheKeyPrefix ?? ''
   }
 
   /**
-   * onCacheKeyCalculation returns the key for the GET request.
-   * The key is used to memoize the request in the LRU cache.
+   * Returns the key of a cache item which belongs to the cache key e.g the stale-if-error item.
+   * The prefix stays the outermost part of the key.
+   */
+  private getCacheItemKey(request: Request, cacheKey: string, item: string): string {
+    const prefix = this.getCacheKeyPrefix(request)
+    // an override of onCacheKeyCalculation may have dropped the prefix
+    const key = prefix && cacheKey.startsWith(prefix) ? cacheKey.slice(prefix.length) : cacheKey
+    return prefix + item + ':' + key
+  }
+
+  /**
+   * onCacheKeyCalculation returns the key for the request.
+   * The key is used to memoize the request in the LRU cache.
+   * Requests other than GET and GET requests with a body are keyed by method, path and a hash
+   * of the body.
+   * The key starts with the **keyPrefix** of the request or the **cacheKeyPrefix** of the
+   * datasource. Keep the prefix when overriding the method to isolate the cache items of tenants.
    *
    * @param request
    * @returns
    */
   protected onCacheKeyCalculation(request: Request): string {
-    return request.origin + request.path
+    const prefix = this.getCacheKeyPrefix(request)
+
+    const hasBody = request.body !== null && request.body !== undefined
+
+    if (request.method === 'GET' && !hasBody) {
+      return prefix + request.origin + request.path
+    }
+
+    // a HEAD response has no body and must not be confused with the GET response
+    const key = prefix + request.method + ' ' + request.origin + request.path
+    if (!hasBody) {
+      return key
+    }
+
+    const body =
+      typeof request.body === 'string' ? request.body : this.stringifyJSON(sortKeys(request.body))
+    return key + ' ' + createHash('sha1').update(body).digest('hex')
   }
 
   /**
@@ -191,7 +1115,7 @@ export abstract class HTTPDataSource<TContext = any> extends DataSource {
     request: Request,
     response: Response<TResult>,
   ): Response<TResult> {
-    if (this.isResponseOk(response.statusCode)) {
+    if (this.isStatusValid(request, response.statusCode)) {
       return response
     }
 
@@ -203,8 +1127,118 @@ export abstract class HTTPDataSource<TContext = any> extends DataSource {
     )
   }
 
+  /**
+   * parseBody is executed when the body of a response has been received and decompressed.
+   * By default JSON responses are parsed and any other response is passed as text
+   * unless a **responseType** was set on the request.
+   *
+   * @param response the response with the raw body
+   * @param request
+   * @returns the parsed body
+   */
+  protected parseBody(response: Response<Buffer>, request: Request): unknown {
+    if (request.responseType === 'arraybuffer') {
+      return response.body
+    }
+
+    const data = response.body.toString('utf-8')
+
+    if (request.responseType === 'text') {
+      return data
+    }
+
+    const contentType = response.headers['content-type']
+    const isJSON = Boolean(contentType?.includes('application/json'))
+
+    if (
+      request.responseType === 'json' &&
+      !isJSON &&
+      data.length &&
+      this.isStatusValid(request, response.statusCode)
+    ) {
+      throw new RequestError(
+        `Expected a JSON response but received content-type '${contentType ?? 'none'}'`,
+        response.statusCode,
+        request,
+        response,
+      )
+    }
+
+    if (isJSON && data.length) {
+      try {
+        return this.parseJSON(data)
+      } catch (error: any) {
+        throw new RequestError(
+          `Response body could not be parsed as JSON: ${error.message}`,
+          response.statusCode,
+          request,
+          response,
+        )
+      }
+    }
+
+    // in case of the server does not properly respond with JSON we pass it as text.
+    // this is necessary since POST, DELETE don't always have a JSON body.
+    return data
+  }
+
   protected onError?(_error: Error, requestOptions: Request): void
 
+  /**
+   * resolveBaseURL returns the base url of the request e.g the nearest region of the api.
+   * It's executed before the cache key is calculated, so responses of different base urls
+   * don't collide. By default the baseURL of the datasource is used.
+   *
+   * @param request
+   * @returns the base url for the request
+   */
+  protected resolveBaseURL?(request: Request): string
+
+  /**
+   * onMemoizeKeyCalculation returns the key to memoize the request. Concurrent requests with
+   * the same key share one in-flight request. By default the key of **onCacheKeyCalculation**
+   * is used, so the memoization can be keyed independently of the shared cache.
+   *
+   * @param request
+   * @returns the memoization key for the request
+   */
+  protected onMemoizeKeyCalculation?(request: Request): string
+
+  /**
+   * onRetry is executed before a failed attempt is retried, after the delay was computed and
+   * before waiting for it. It isn't executed for the last failure. The request can be modified
+   * for the next attempt e.g to add headers.
+   *
+   * @param error the error of the failed attempt
+   * @param request
+   * @param attempt the failed attempt starting at 1
+   * @param delay the delay in milliseconds before the next attempt
+   */
+  protected onRetry?(
+    error: Error,
+    request: Request,
+    attempt: number,
+    delay: number,
+  ): void | Promise<void>
+
+  /**
+   * onCacheHit is executed when a response is served from the memoization or the request cache.
+   *
+   * @param request
+   * @param cacheKey
+   * @param source the cache layer which served the response
+   */
+  protected onCacheHit?(request: Request, cacheKey: string, source: CacheSource): void
+
+  /**
+   * onCacheMiss is executed when the memoization or the request cache has no response.
+   *
+   * @param request
+   * @param cacheKey
+   * @param source the cache layer which was consulted
+   */
+  protected onCacheMiss?(request: Request, cacheKey: string, source: CacheSource): void
+
   /**
    * Execute a HTTP GET request.
    * Note that the **memoizedResults** and **cache** will be checked before request is made.
@@ -230,6 +1264,87 @@ export abstract class HTTPDataSource<TContext = any> extends DataSource {
     })
   }
 
+  /**
+   * Execute a HTTP GET request and respond with the body as a stream.
+   * The response is neither memoized nor cached and the body isn't parsed.
+   * The caller is responsible for consuming or destroying the stream.
+   *
+   * @param path the path to the resource
+   * @param requestOptions
+   */
+  public async stream(
+    path: string,
+    requestOptions?: Omit<RequestOptions, 'memoize' | 'requestCache' | 'responseType'>,
+  ): Promise<Response<Readable>> {
+    return this.request<Readable>({
+      headers: {},
+      query: {},
+      body: null,
+      context: {},
+      ...requestOptions,
+      memoize: false,
+      responseType: 'stream',
+      method: 'GET',
+      path,
+      origin: this.baseURL,
+    })
+  }
+
+  /**
+   * Execute a HTTP GET request to fill the request cache e.g to warm up the cache on startup.
+   * The cache isn't read and the response isn't memoized, so it can be called outside of a
+   * graphql operation once the datasource was initialized with a cache.
+   *
+   * @param path the path to the resource
+   * @param requestOptions
+   * @returns *true* if the response was stored in the cache
+   */
+  public async prefetch(
+    path: string,
+    requestOptions?: Omit<RequestOptions, 'memoize' | 'responseType'>,
+  ): Promise<boolean> {
+    const request: Request = {
+      headers: {},
+      query: {},
+      body: null,
+      context: {},
+      ...requestOptions,
+      memoize: false,
+      method: 'GET',
+      path,
+      origin: this.baseURL,
+    }
+    // stays false when the response isn't cacheable or a stale response was served
+    const prefetch = { stored: false }
+    this.prefetches.set(request, prefetch)
+
+    await this.request(request)
+
+    return prefetch.stored
+  }
+
+  /**
+   * Execute a HTTP HEAD request.
+   * The response contains the status and headers but no body.
+   * By default the received response will be memoized.
+   *
+   * @param path the path to the resource
+   * @param requestOptions
+   */
+  public async head(path: string, requestOptions?: RequestOptions): Promise<Response<undefined>> {
+    return this.request<undefined>({
+      headers: {},
+      query: {},
+      body: null,
+      memoize: true,
+      context: {},
+      ...requestOptions,
+      method: 'HEAD',
+      path,
+      origin: this.baseURL,
+    })
+  }
+
   public async post<TResult = unknown>(
     path: string,
     requestOptions?: RequestOptions,
@@ -294,102 +1409,762 @@ export abstract class HTTPDataSource<TContext = any> extends DataSource {
     })
   }
 
-  private async performRequest<TResult>(
+  /**
+   * Executes the requests with at most **concurrency** requests in flight. The requests pass the
+   * memoization, cache and retries like any other request. The results preserve the order of the
+   * requests. By default the first failure rejects and no further requests are started, with
+   * **settle** all requests are executed and their settled results are returned.
+   *
+   * @param requests
+   * @param options
+   */
+  public async all<TResult = unknown>(
+    requests: BatchRequest[],
+    options?: BatchOptions & { settle?: false },
+  ): Promise<Response<TResult>[]>
+  public async all<TResult = unknown>(
+    requests: BatchRequest[],
+    options: BatchOptions & { settle: true },
+  ): Promise<PromiseSettledResult<Response<TResult>>[]>
+  public async all<TResult = unknown>(
+    requests: BatchRequest[],
+    options?: BatchOptions,
+  ): Promise<Response<TResult>[] | PromiseSettledResult<Response<TResult>>[]> {
+    const concurrency = Math.max(1, options?.concurrency ?? Infinity)
+    const results: PromiseSettledResult<Response<TResult>>[] = new Array(requests.length)
+    let next = 0
+    let failed = false
+
+    const execute = (request: BatchRequest): Promise<Response<TResult>> => {
+      switch (request.method) {
+        case 'GET':
+          return this.get<TResult>(request.path, request.options)
+        case 'HEAD':
+          return this.head(request.path, request.options) as Promise<Response<any>>
+        case 'POST':
+          return this.post<TResult>(request.path, request.options)
+        case 'PUT':
+          return this.put<TResult>(request.path, request.options)
+        case 'PATCH':
+          return this.patch<TResult>(request.path, request.options)
+        case 'DELETE':
+          return this.delete<TResult>(request.path, request.options)
+      }
+    }
+
+    const worker = async () => {
+      while (next < requests.length && !failed) {
+        const index = next++
+        try {
+          results[index] = { status: 'fulfilled', value: await execute(requests[index]) }
+        } catch (error) {
+          if (!options?.settle) {
+            failed = true
+            throw error
+          }
+          results[index] = { status: 'rejected', reason: error }
+        }
+      }
+    }
+
+    await Promise.all(
+      Array.from({ length: Math.min(concurrency, requests.length) }, () => worker()),
+    )
+
+    if (options?.settle) {
+      return results
+    }
+    return results.map((result) => (result as PromiseFulfilledResult<Response<TResult>>).value)
+  }
+
+  /**
+   * Buffers the (decoded) response body. The request is aborted with a ResponseTooLargeError
+   * as soon as the body exceeds **maxResponseSize** or the compressed body exceeds
+   * **maxCompressedResponseSize**.
+   */
+  private readBody(
+    responseData: ResponseData,
     request: Request,
-    cacheKey: string,
-  ): Promise<Response<TResult>> {
-    try {
-      // in case of JSON set appropriate content-type header
-      if (request.body !== null && typeof request.body === 'object') {
-        if (request.headers['content-type'] === undefined) {
-          request.headers['content-type'] = 'application/json; charset=utf-8'
+    decoder?: Transform,
+  ): Promise<Buffer> {
+    const maxResponseSize = request.maxResponseSize ?? this.options?.maxResponseSize
+    const maxCompressedResponseSize =
+      request.maxCompressedResponseSize ?? this.options?.maxCompressedResponseSize
+    const body = responseData.body
+    const stream: Readable = decoder ? body.pipe(decoder) : body
+
+    return new Promise((resolve, reject) => {
+      const chunks: Buffer[] = []
+      let size = 0
+      let compressedSize = 0
+
+      const abort = (message: string, limit: number) => {
+        body.destroy()
+        decoder?.destroy()
+        reject(new ResponseTooLargeError(message, limit, responseData.statusCode, request))
+      }
+
+      if (decoder && maxCompressedResponseSize !== undefined) {
+        const limit = maxCompressedResponseSize
+        body.on('data', (chunk: Buffer) => {
+          compressedSize += chunk.length
+          if (compressedSize > limit) {
+            abort(`Compressed response body exceeds the maximum size of ${limit} bytes`, limit)
+          }
+        })
+      }
+
+      stream.on('data', (chunk: Buffer) => {
+        size += chunk.length
+        if (maxResponseSize !== undefined && size > maxResponseSize) {
+          abort(
+            `Response body exceeds the maximum size of ${maxResponseSize} bytes`,
+            maxResponseSize,
+          )
+          return
         }
-        request.body = JSON.stringify(request.body)
+        chunks.push(chunk)
+      })
+      stream.once('end', () => resolve(Buffer.concat(chunks)))
+      stream.once('error', reject)
+      // errors of the body aren't forwarded to the decoder
+      body.once('error', reject)
+    })
+  }
+
+  /**
+   * Returns the dispatcher for the origin. A pool is bound to the origin of the baseURL.
+   * Requests to a base url resolved by **resolveBaseURL** are sent with the pool of the origin,
+   * requests to other origins e.g a redirect are sent with the global dispatcher of undici.
+   */
+  private getDispatcher(origin: string, request: Request): Dispatcher {
+    if (
+      !(this.dispatcher instanceof Pool || this.dispatcher instanceof Client) ||
+      origin === new URL(this.baseURL).origin
+    ) {
+      return this.dispatcher
+    }
+
+    if (origin === new URL(request.origin).origin) {
+      let pool = this.pools.get(origin)
+      if (!pool) {
+        pool = new Pool(origin, this.options?.clientOptions)
+        this.pools.set(origin, pool)
       }
+      return pool
+    }
 
-      await this.onRequest?.(request)
+    return getGlobalDispatcher()
+  }
+
+  /**
+   * Closes the pool of an origin which was resolved by **resolveBaseURL** e.g when a region
+   * is no longer used. The pool is created again by the next request to the origin.
+   *
+   * @param baseURL
+   */
+  public async closePool(baseURL: string): Promise<void> {
+    const origin = new URL(baseURL).origin
+    const pool = this.pools.get(origin)
+    if (pool) {
+      this.pools.delete(origin)
+      await pool.close()
+    }
+  }
+
+  /**
+   * Sends the request with the dispatcher of the origin, keeps the raw headers of the response
+   * and measures the timings of the attempt.
+   */
+  private async dispatchTo(
+    request: Request,
+    options: Dispatcher.RequestOptions,
+    url: URL,
+  ): Promise<ResponseData> {
+    const dispatcher = this.getDispatcher(url.origin, request)
+
+    // fail fast instead of growing the queue of a slow upstream without bound
+    const maxQueuedRequests = this.options?.maxQueuedRequests
+    const queued = (dispatcher as Partial<Pool>).stats?.queued
+    if (maxQueuedRequests !== undefined && queued !== undefined && queued >= maxQueuedRequests) {
+      throw new PoolExhaustedError(
+        `The pool of ${url.origin} has ${queued} queued requests: ${request.path}`,
+        maxQueuedRequests,
+        request,
+      )
+    }
+
+    const timings = attemptTimings.get(request)
+    if (timings) {
+      // a redirect starts over
+      timings.start = performance.now()
+      timings.sent = undefined
+      timings.headers = undefined
+      timings.connect = undefined
+    }
 
+    // the handler of the request is wrapped by dispatching through a derived dispatcher
+    const rawHeaders: string[] = []
+    const wrapped: Dispatcher = Object.create(dispatcher)
+    wrapped.dispatch = (dispatchOptions, handler) =>
+      dispatcher.dispatch(dispatchOptions, new AttemptHandler(handler, rawHeaders, timings))
+    const responseData = await wrapped.request(options)
+    responseRawHeaders.set(responseData, rawHeaders)
+    return responseData
+  }
+
+  /**
+   * Sends the request with the dispatcher of the origin. The cookies of the **cookieJar** are
+   * appended to the cookie header of the request and the cookies of the response are stored.
+   */
+  private async send(
+    request: Request,
+    options: Dispatcher.RequestOptions,
+    url: URL,
+  ): Promise<ResponseData> {
+    const cookieJar = this.options?.cookieJar
+    if (!cookieJar) {
+      return this.dispatchTo(request, options, url)
+    }
+
+    const cookies = await cookieJar.getCookieString(url.toString())
+    if (cookies) {
+      const headers = { ...(options.headers as Dictionary<string>) }
+      const name = findHeaderName(headers, 'cookie') ?? 'cookie'
+      headers[name] = headers[name] ? `${headers[name]}; ${cookies}` : cookies
+      options = { ...options, headers }
+    }
+
+    const responseData = await this.dispatchTo(request, options, url)
+
+    const setCookie = responseData.headers['set-cookie']
+    for (const cookie of Array.isArray(setCookie) ? setCookie : setCookie ? [setCookie] : []) {
+      try {
+        await cookieJar.setCookie(cookie, url.toString())
+      } catch (error: any) {
+        // e.g a cookie for another domain
+        this.log('warn', 'cookie:rejected', request, { url: url.toString(), error: error.message })
+      }
+    }
+
+    return responseData
+  }
+
+  /**
+   * Follows up to **maxRedirects** redirects of the response.
+   * The credentials (authorization, proxy-authorization and cookie headers) are dropped on
+   * cross-origin redirects unless **keepAuthorizationOnRedirect** is set.
+   */
+  private async followRedirects(
+    request: Request,
+    requestOptions: Dispatcher.RequestOptions,
+    responseData: ResponseData,
+  ): Promise<{ responseData: ResponseData; url: string }> {
+    const maxRedirects = request.maxRedirects ?? 0
+    let url = new URL(request.path, request.origin)
+    let options = requestOptions
+
+    for (let redirects = 0; maxRedirects > 0; redirects++) {
+      const location = responseData.headers['location']
+      if (!redirectStatusCodes.has(responseData.statusCode) || !location) {
+        break
+      }
+
+      // release the connection
+      await streamToPromise(responseData.body)
+
+      if (redirects === maxRedirects) {
+        throw new TooManyRedirectsError(
+          `Maximum of ${maxRedirects} redirects exceeded at ${url}`,
+          responseData.statusCode,
+          request,
+        )
+      }
+
+      const redirectURL = new URL(location, url)
+      const headers = { ...(options.headers as Dictionary<string>) }
+
+      if (redirectURL.origin !== url.origin && !request.keepAuthorizationOnRedirect) {
+        for (const name of credentialHeaders) {
+          deleteHeader(headers, name)
+        }
+      }
+
+      // rfc7231 6.4.2, 6.4.3, 6.4.4
+      let method = options.method
+      let body = options.body
+      if (
+        responseData.statusCode === 303 ||
+        (method === 'POST' && (responseData.statusCode === 301 || responseData.statusCode === 302))
+      ) {
+        method = method === 'HEAD' ? 'HEAD' : 'GET'
+        body = null
+        deleteHeader(headers, 'content-type')
+        deleteHeader(headers, 'content-encoding')
+      }
+
+      url = redirectURL
+      options = {
+        ...options,
+        origin: url.origin,
+        path: url.pathname + url.search,
+        method,
+        headers,
+        body,
+      }
+      responseData = await this.send(request, options, url)
+    }
+
+    return { responseData, url: url.toString() }
+  }
+
+  /**
+   * Sends the request and resolves the response.
+   * Undici errors are converted to the errors of this package.
+   */
+  private async dispatch<TResult>(request: Request): Promise<Response<TResult>> {
+    if (this.options?.collectTimings) {
+      attemptTimings.set(request, { start: performance.now() })
+    }
+
+    try {
       const requestOptions: Dispatcher.RequestOptions = {
         method: request.method,
         origin: request.origin,
         path: request.path,
         headers: request.headers,
         signal: request.signal,
-        body: request.body as string,
+        body: request.body as Dispatcher.DispatchOptions['body'],
+        headersTimeout: request.timeouts?.headers,
+        bodyTimeout: request.timeouts?.body,
+      }
+
+      const { responseData, url } = await this.followRedirects(
+        request,
+        requestOptions,
+        await this.send(request, requestOptions, new URL(request.path, request.origin)),
+      )
+      if (request.responseType === 'stream') {
+        const response: Response<TResult> = {
+          isFromCache: false,
+          memoized: false,
+          ...responseData,
+          url,
+          rawHeaders: responseRawHeaders.get(responseData),
+          timings: this.getAttemptTimings(request, false),
+          body: responseData.body as unknown as TResult,
+        }
+        try {
+          this.onResponse<TResult>(request, response)
+        } catch (error) {
+          // nobody will consume the body of the unsuccessful response
+          responseData.body.destroy()
+          throw error
+        }
+        return response
       }
 
-      const responseData = await this.pool.request(requestOptions)
-      const body = responseData.body
       const headers = responseData.headers
 
+      // binary responses are passed as received, HEAD, 204 and 304 responses have no body
+      // even when the content-encoding of the representation is announced
+      const decompress =
+        request.responseType !== 'arraybuffer' &&
+        request.method !== 'HEAD' &&
+        responseData.statusCode !== 204 &&
+        responseData.statusCode !== 304 &&
+        (request.decompress ?? this.options?.decompress ?? true)
+
       let dataBuffer: Buffer
-      switch (headers['content-encoding']) {
+      switch (decompress ? headers['content-encoding'] : undefined) {
         case 'br':
-          dataBuffer = await streamToPromise(body.pipe(createBrotliDecompress()))
+          dataBuffer = await this.readBody(responseData, request, createBrotliDecompress())
           break
         case 'gzip':
         case 'deflate':
-          dataBuffer = await streamToPromise(body.pipe(createUnzip()))
+          dataBuffer = await this.readBody(responseData, request, createUnzip())
           break
         default:
-          dataBuffer = await streamToPromise(body)
+          dataBuffer = await this.readBody(responseData, request)
           break
       }
 
-      // This will be string initially, but may become any once JSON parsed.
-      let data: any = dataBuffer.toString('utf-8')
-
-      // can we parse it as JSON?
-      if (
-        responseData.headers['content-type']?.includes('application/json') &&
-        data.length &&
-        typeof data === 'string'
-      ) {
-        data = JSON.parse(data)
-      }
-      const response: Response<TResult> = {
+      const rawResponse: Response<Buffer> = {
         isFromCache: false,
         memoized: false,
         ...responseData,
-        // in case of the server does not properly respond with JSON we pass it as text.
-        // this is necessary since POST, DELETE don't always have a JSON body.
-        body: data as unknown as TResult,
+        url,
+        rawHeaders: responseRawHeaders.get(responseData),
+        timings: this.getAttemptTimings(request, true),
+        body: dataBuffer,
+      }
+      const response: Response<TResult> = {
+        ...rawResponse,
+        // a HEAD response never has a body
+        body: (request.method === 'HEAD'
+          ? undefined
+          : this.parseBody(rawResponse, request)) as TResult,
       }
 
       this.onResponse<TResult>(request, response)
 
-      if (this.isRequestMemoizable(request)) {
-        this.memoizedResults.set(cacheKey, response)
+      return response
+    } catch (error: any) {
+      if (error instanceof errors.RequestAbortedError) {
+        throw new RequestAbortedError(error.message, request)
+      } else if (error instanceof errors.HeadersTimeoutError) {
+        throw new RequestTimeoutError(error.message, 'headers', request)
+      } else if (error instanceof errors.BodyTimeoutError) {
+        throw new RequestTimeoutError(error.message, 'body', request)
+      } else if (error instanceof RequestError) {
+        throw error
+      }
+      throw new RequestError(error.message, 0, request, undefined, error)
+    }
+  }
+
+  /**
+   * Checks if a failed attempt should be retried. The **shouldRetry** option takes
+   * precedence over the **retryableStatusCodes**.
+   */
+  private isRetryable(error: Error, request: Request, attempt: number): boolean {
+    const retry = request.retry
+    if (!retry || attempt > retry.maxRetries) {
+      return false
+    }
+
+    if (retry.shouldRetry) {
+      return retry.shouldRetry(error, request, attempt)
+    }
+
+    if (error instanceof PoolExhaustedError) {
+      return retry.retryOnPoolExhausted === true
+    }
+
+    // a cancelled request, a redirect loop or an oversized response is not retried
+    if (
+      error instanceof RequestAbortedError ||
+      error instanceof TooManyRedirectsError ||
+      error instanceof ResponseTooLargeError
+    ) {
+      return false
+    }
+
+    if (error instanceof RequestError && error.response) {
+      const retryableStatusCodes = retry.retryableStatusCodes ?? defaultRetryableStatusCodes
+      return retryableStatusCodes.includes(error.code)
+    }
+
+    // timeouts and network errors
+    return true
+  }
+
+  /**
+   * Returns the delay in milliseconds before the failed attempt (starting at 1) is retried.
+   * The exponential backoff is randomized according to **jitter**. The delay is at least the
+   * Retry-After of a 429 or 503 response, capped at **maxRetryAfter**.
+   */
+  protected getRetryDelay(error: Error, request: Request, attempt: number): number {
+    const backoff = (request.retry?.delay ?? 100) * 2 ** (attempt - 1)
+
+    let delay: number
+    switch (request.retry?.jitter ?? 'full') {
+      case 'none':
+        delay = backoff
+        break
+      case 'equal':
+        delay = backoff / 2 + Math.random() * (backoff / 2)
+        break
+      default:
+        delay = Math.random() * backoff
+        break
+    }
+
+    // don't wait longer than maxRetryAfter for the upstream to recover
+    const retryAfter =
+      error instanceof RequestError && error.response && retryAfterStatusCodes.has(error.code)
+        ? getRetryAfter(error.response.headers)
+        : undefined
+    if (retryAfter !== undefined) {
+      delay = Math.max(delay, Math.min(retryAfter, request.retry?.maxRetryAfter ?? 60000))
+    }
+
+    return Math.round(delay)
+  }
+
+  /**
+   * Returns the timings of the current attempt of the request.
+   *
+   * @param request
+   * @param received if the body was received
+   */
+  private getAttemptTimings(request: Request, received: boolean): Timings | undefined {
+    const timings = attemptTimings.get(request)
+    if (!timings) {
+      return undefined
+    }
+
+    const end = performance.now()
+    const headers = timings.headers ?? end
+    return {
+      queued: timings.sent !== undefined ? timings.sent - timings.start : undefined,
+      connect: timings.connect,
+      ttfb: headers - (timings.sent ?? timings.start),
+      download: received ? end - headers : undefined,
+      total: end - timings.start,
+      retryCount: 0,
+      fromCache: false,
+    }
+  }
+
+  /**
+   * Logs a structured event of the request with the **logger** e.g
+   * `{ event: 'request:retry', method: 'GET', url, attempt: 1, delay: 100, error }`.
+   */
+  private log(
+    level: 'debug' | 'info' | 'warn' | 'error',
+    event: string,
+    request: Request,
+    fields?: Dictionary<unknown>,
+  ): void {
+    this.logger?.[level]({
+      event,
+      method: request.method,
+      url: request.origin + request.path,
+      ...fields,
+    })
+  }
+
+  private cacheHit(request: Request, cacheKey: string, source: CacheSource): void {
+    this.log('debug', 'cache:hit', request, { cacheKey, source })
+    this.onCacheHit?.(request, cacheKey, source)
+  }
+
+  private cacheMiss(request: Request, cacheKey: string, source: CacheSource): void {
+    this.log('debug', 'cache:miss', request, { cacheKey, source })
+    this.onCacheMiss?.(request, cacheKey, source)
+  }
+
+  /**
+   * Returns the timings of a response which was served from the memoization or the request cache.
+   */
+  private getCacheTimings(): Timings | undefined {
+    return this.options?.collectTimings ? { total: 0, retryCount: 0, fromCache: true } : undefined
+  }
+
+  private async dispatchWithRetry<TResult>(request: Request): Promise<Response<TResult>> {
+    const start = performance.now()
+    for (let attempt = 1; ; attempt++) {
+      try {
+        const response = await this.dispatch<TResult>(request)
+        if (response.timings) {
+          response.timings.total = performance.now() - start
+          response.timings.retryCount = attempt - 1
+        }
+        return response
+      } catch (error: any) {
+        if (error instanceof RequestError) {
+          error.attempt = attempt
+        }
+
+        if (!this.isRetryable(error, request, attempt)) {
+          throw error
+        }
+
+        request.span?.setAttribute('http.retry_count', attempt)
+
+        const delay = this.getRetryDelay(error, request, attempt)
+        this.log('warn', 'request:retry', request, { attempt, delay, error: error.message })
+        await this.onRetry?.(error, request, attempt, delay)
+        await new Promise((resolve) => setTimeout(resolve, delay))
+      }
+    }
+  }
+
+  /**
+   * Refreshes the token once and repeats the request when the token of the provider was rejected.
+   * Concurrent refreshes of the same provider are coalesced into one.
+   */
+  private async dispatchWithAuthRefresh<TResult>(
+    request: Request,
+    authProvider: AuthProvider,
+  ): Promise<Response<TResult>> {
+    try {
+      return await this.dispatchWithRetry<TResult>(request)
+    } catch (error: any) {
+      if (!(error instanceof RequestError && error.code === 401 && authProvider.refreshToken)) {
+        throw error
+      }
+
+      let tokenRefresh = tokenRefreshes.get(authProvider)
+      if (!tokenRefresh) {
+        tokenRefresh = authProvider
+          .refreshToken()
+          .finally(() => tokenRefreshes.delete(authProvider))
+        tokenRefreshes.set(authProvider, tokenRefresh)
+      }
+
+      request.headers['authorization'] = `Bearer ${await tokenRefresh}`
+
+      return this.dispatchWithRetry<TResult>(request)
+    }
+  }
+
+  private async performRequest<TResult>(
+    request: Request,
+    cacheKey: string,
+    memoizeKey: string,
+    revalidatedResponse?: Response<TResult>,
+  ): Promise<Response<TResult>> {
+    try {
+      if (isFormData(request.body)) {
+        // the content-type must announce the boundary of the body
+        const boundary = `----FormDataBoundary${randomBytes(16).toString('hex')}`
+        request.body = await serializeFormData(request.body, boundary)
+        deleteHeader(request.headers, 'content-type')
+        request.headers['content-type'] = `multipart/form-data; boundary=${boundary}`
+      } else if (request.body !== null && typeof request.body === 'object') {
+        // in case of JSON set appropriate content-type header
+        if (findHeaderName(request.headers, 'content-type') === undefined) {
+          request.headers['content-type'] = 'application/json; charset=utf-8'
+        }
+        request.body = this.stringifyJSON(request.body)
+      }
+
+      // an explicit authorization header takes precedence over the auth provider
+      const authProvider =
+        findHeaderName(request.headers, 'authorization') === undefined
+          ? this.options?.authProvider
+          : undefined
+      if (authProvider) {
+        request.headers['authorization'] = `Bearer ${await authProvider.getToken()}`
       }
 
-      // let's see if we can fill the shared cache
-      if (request.requestCache && this.isResponseCacheable<TResult>(request, response)) {
-        response.maxTtl = request.requestCache.maxTtl
-        const cachedResponse = JSON.stringify(response)
+      await this.onRequest?.(request)
+
+      // the compressed buffer is reused for every attempt
+      const body = request.body
+      if (
+        request.compression &&
+        (typeof body === 'string' || Buffer.isBuffer(body)) &&
+        Buffer.byteLength(body) >= (request.compressionThreshold ?? 1024)
+      ) {
+        request.body = request.compression === 'br' ? await brotliCompress(body) : await gzip(body)
+        deleteHeader(request.headers, 'content-encoding')
+        request.headers['content-encoding'] = request.compression
+      }
+
+      this.log('debug', 'request:start', request)
+
+      let response = authProvider
+        ? await this.dispatchWithAuthRefresh<TResult>(request, authProvider)
+        : await this.dispatchWithRetry<TResult>(request)
+
+      // the cached response is still valid
+      if (revalidatedResponse && response.statusCode === 304) {
+        response = {
+          ...revalidatedResponse,
+          memoized: false,
+          isFromCache: true,
+          timings: response.timings && { ...response.timings, fromCache: true },
+        }
+      }
+
+      const requestCache = this.resolveRequestCache(request, response)
+
+      // a maxTtl function which returns false opts out of the memoization too
+      const isCacheDisabled = typeof request.requestCache?.maxTtl === 'function' && !requestCache
+      if (this.isRequestMemoizable(request) && !isCacheDisabled) {
+        this.memoizedResults.set(memoizeKey, response)
+      }
+
+      // let's see if we can fill the shared cache, a stream is consumable once
+      if (
+        requestCache &&
+        request.responseType !== 'stream' &&
+        this.isResponseCacheable<TResult>(request, response)
+      ) {
+        response.maxTtl = requestCache.maxTtl
+        const cachedResponse = this.stringifyCacheItem(response)
+        const stores: Promise<boolean>[] = []
+        const store = (key: string, ttl: number) =>
+          stores.push(
+            this.cache.set(key, cachedResponse, { ttl }).then(
+              () => true,
+              (error) => {
+                this.log('error', 'cache:setError', request, { cacheKey, error: error.message })
+                return false
+              },
+            ),
+          )
+
+        store(cacheKey, requestCache.maxTtl)
+        if (requestCache.serveStaleOnError !== false) {
+          store(
+            this.getCacheItemKey(request, cacheKey, 'staleIfError'),
+            requestCache.maxTtl + requestCache.maxTtlIfError,
+          )
+        }
+
+        if (requestCache.swr) {
+          store(
+            this.getCacheItemKey(request, cacheKey, 'staleWhileRevalidate'),
+            requestCache.maxTtl + requestCache.swr,
+          )
+        }
+
+        if (
+          requestCache.revalidate &&
+          (response.headers['etag'] || response.headers['last-modified'])
+        ) {
+          store(
+            this.getCacheItemKey(request, cacheKey, 'revalidate'),
+            requestCache.maxTtl + requestCache.maxTtlIfError,
+          )
+        }
 
-        // respond with the result immediately without waiting for the cache
-        this.cache
-          .set(cacheKey, cachedResponse, {
-            ttl: request.requestCache.maxTtl,
-          })
-          .catch((err) => this.logger?.error(err))
-        this.cache
-          .set(`staleIfError:${cacheKey}`, cachedResponse, {
-            ttl: request.requestCache.maxTtl + request.requestCache.maxTtlIfError,
-          })
-          .catch((err) => this.logger?.error(err))
+        // respond with the result immediately without waiting for the cache, a prefetch
+        // reports whether the response was stored
+        const prefetch = this.prefetches.get(request)
+        if (prefetch) {
+          prefetch.stored = (await Promise.all(stores)).every(Boolean)
+        }
       }
       return response
     } catch (error: any) {
-      this.onError?.(error, request)
+      // the error could end up in logs, don't expose credentials or personal data
+      const redactedRequest = this.redactRequest(request)
+      if (error instanceof RequestError) {
+        error.request = redactedRequest
+        if (error.response) {
+          error.response = this.redactResponse(error.response)
+        }
+      }
+
+      this.log('error', 'request:error', redactedRequest, {
+        statusCode: error instanceof RequestError ? error.code : undefined,
+        attempt: error instanceof RequestError ? error.attempt : undefined,
+        error: error.message,
+      })
+      this.onError?.(error, redactedRequest)
 
       // in case of an error we try to respond with a stale result from the stale-if-error cache
-      if (request.requestCache) {
-        const cacheItem = await this.cache.get(`staleIfError:${cacheKey}`)
+      // an aborted request was cancelled on purpose and must not be answered from the cache
+      if (
+        request.requestCache &&
+        request.requestCache.serveStaleOnError !== false &&
+        !(error instanceof RequestAbortedError)
+      ) {
+        const staleIfErrorKey = this.getCacheItemKey(request, cacheKey, 'staleIfError')
+        const cacheItem = await this.cache.get(staleIfErrorKey)
 
         if (cacheItem) {
-          const response: Response<TResult> = JSON.parse(cacheItem)
+          const response = this.parseCacheItem<TResult>(cacheItem)
+          response.memoized = false
           response.isFromCache = true
+          response.isStale = true
+          response.timings = this.getCacheTimings()
+          this.cacheHit(request, cacheKey, 'requestCache')
           return response
         }
       }
@@ -398,64 +2173,390 @@ export abstract class HTTPDataSource<TContext = any> extends DataSource {
     }
   }
 
+  /**
+   * Returns the cache options for the response. When **respectCacheControl** is enabled
+   * the Cache-Control and Expires headers of the response are considered. An explicit
+   * **requestCache** of the request takes precedence over the header ttl.
+   * A **maxTtl** function is resolved with the response.
+   */
+  private resolveRequestCache<TResult>(
+    request: Request,
+    response: Response<TResult>,
+  ): ResolvedRequestCache | undefined {
+    const requestCache = request.requestCache
+    let resolvedRequestCache: ResolvedRequestCache | undefined
+    if (requestCache) {
+      const maxTtl =
+        typeof requestCache.maxTtl === 'function'
+          ? requestCache.maxTtl(response as Response<unknown>)
+          : requestCache.maxTtl
+      if (maxTtl === false) {
+        return undefined
+      }
+      resolvedRequestCache = { ...requestCache, maxTtl }
+    }
+
+    if (!this.options?.respectCacheControl) {
+      return resolvedRequestCache
+    }
+
+    const ttl = getCacheControlTtl(response.headers)
+    if (ttl === false) {
+      return undefined
+    }
+    if (resolvedRequestCache) {
+      return resolvedRequestCache
+    }
+    if (ttl === undefined) {
+      return undefined
+    }
+
+    return {
+      maxTtl: ttl,
+      maxTtlIfError: 0,
+    }
+  }
+
+  /**
+   * Refreshes the cache item in the background. Errors are logged but never thrown
+   * and only one refresh per cache key is in flight.
+   */
+  private revalidate(request: Request, cacheKey: string, memoizeKey: string): void {
+    if (backgroundRevalidations.has(cacheKey)) {
+      return
+    }
+
+    backgroundRevalidations.add(cacheKey)
+
+    this.performRequest(request, cacheKey, memoizeKey)
+      .catch((error) =>
+        this.log('error', 'cache:revalidateError', request, { cacheKey, error: error.message }),
+      )
+      .finally(() => backgroundRevalidations.delete(cacheKey))
+  }
+
+  /**
+   * Wraps the request in a span when a **tracer** is configured.
+   * The span context is propagated with the W3C traceparent header.
+   */
   private async request<TResult = unknown>(request: Request): Promise<Response<TResult>> {
+    const tracer = this.options?.tracer
+    if (!tracer) {
+      return this.handleRequest<TResult>(request)
+    }
+
+    const span = tracer.startSpan(`${request.method} ${request.path}`, {
+      kind: spanKindClient,
+      attributes: {
+        'http.method': request.method,
+      },
+    })
+    const { traceId, spanId, traceFlags } = span.spanContext()
+    request.headers = {
+      ...request.headers,
+      traceparent: `00-${traceId}-${spanId}-${traceFlags.toString(16).padStart(2, '0')}`,
+    }
+    request.span = span
+
+    try {
+      const response = await this.handleRequest<TResult>(request)
+      span.setAttribute('http.status_code', response.statusCode)
+      span.setAttribute('http.cache_hit', response.isFromCache || response.memoized)
+      return response
+    } catch (error: any) {
+      if (error instanceof RequestError) {
+        span.setAttribute('http.status_code', error.code)
+      }
+      span.recordException(error)
+      span.setStatus({ code: spanStatusCodeError, message: error.message })
+      throw error
+    } finally {
+      span.setAttribute('http.url', request.origin + request.path)
+      span.end()
+    }
+  }
+
+  private async handleRequest<TResult = unknown>(request: Request): Promise<Response<TResult>> {
+    if (this.closed) {
+      throw new DataSourceClosedError(`The datasource was closed: ${request.path}`)
+    }
+
+    // the options of the request take precedence over the global requestOptions
+    const globalRequestOptions = this.globalRequestOptions as Dictionary<unknown> | undefined
+    const requestOptions = request as unknown as Dictionary<unknown>
+    for (const name in globalRequestOptions) {
+      if (name !== 'memoize' && requestOptions[name] === undefined) {
+        requestOptions[name] = globalRequestOptions[name]
+      }
+    }
+    // a global memoize: false disables the memoization but never opts requests in
+    if (this.globalRequestOptions?.memoize === false) {
+      request.memoize = false
+    }
+
+    // the context of the request is available to every hook including the cache key calculation
+    request.context = { ...this.globalRequestOptions?.context, ...request.context }
+
+    if (this.resolveBaseURL) {
+      request.origin = this.resolveBaseURL(request)
+    }
+
+    if (request.params) {
+      const params = request.params
+      request.path = request.path.replace(pathParamPattern, (_match, name: string) => {
+        const value = params[name]
+        if (value === undefined) {
+          throw new Error(`Missing path parameter '${name}' of the path: ${request.path}`)
+        }
+        return '/' + encodeURIComponent(value)
+      })
+    }
+
     if (Object.keys(request.query).length > 0) {
-      request.path = request.path + '?' + this.buildQueryString(request.query)
+      const queryString = this.buildQueryString(
+        request.query,
+        request.querySerializer ?? this.options?.querySerializer ?? 'repeat',
+      )
+      if (queryString) {
+        request.path = request.path + '?' + queryString
+      }
     }
 
-    const cacheKey = this.onCacheKeyCalculation(request)
+    // a stream can only be consumed once and has no stable representation for the key
+    if (this.isRequestMemoizable(request) && request.body instanceof Readable) {
+      throw new Error(`A request with a stream body can't be memoized: ${request.path}`)
+    }
 
     const isRequestMemoizable = this.isRequestMemoizable(request)
 
+    // hashing the body isn't for free, the key is only calculated when it's used
+    const isCacheKeyUsed =
+      isRequestMemoizable ||
+      request.requestCache !== undefined ||
+      Boolean(this.options?.respectCacheControl) ||
+      (request.method === 'GET' && Boolean(this.options?.dedupeWindowMs))
+    const cacheKey = isCacheKeyUsed ? this.onCacheKeyCalculation(request) : ''
+
+    if (!isRequestMemoizable) {
+      return this.dedupeRequest<TResult>(request, cacheKey, cacheKey)
+    }
+
+    const memoizeKey = this.onMemoizeKeyCalculation?.(request) ?? cacheKey
+
     // check if we have a memoizable call in the cache to respond immediately
-    if (isRequestMemoizable) {
-      // Memoize calls for the same data source instance
-      // a single instance of the data sources is scoped to one graphql request
-      if (this.memoizedResults.has(cacheKey)) {
-        const response = await this.memoizedResults.get(cacheKey)!
-        response.memoized = true
-        response.isFromCache = false
-        return response
+    // Memoize calls for the same data source instance
+    // a single instance of the data sources is scoped to one graphql request
+    if (this.memoizedResults.has(memoizeKey)) {
+      const response = await this.memoizedResults.get(memoizeKey)!
+      response.memoized = true
+      response.isFromCache = false
+      response.timings = this.getCacheTimings()
+      this.cacheHit(request, memoizeKey, 'memoize')
+      return response
+    }
+
+    // share the pending response with concurrent requests of the same key
+    let inflight = this.inflightRequests.get(memoizeKey)
+    while (inflight) {
+      this.cacheHit(request, memoizeKey, 'memoize')
+      try {
+        const response = await inflight
+        return { ...response, memoized: true, timings: this.getCacheTimings() }
+      } catch (error) {
+        // the abort of another caller must not reject this request, it's sent again
+        const signal = request.signal as { aborted?: boolean } | null | undefined
+        if (!(error instanceof RequestAbortedError) || signal?.aborted) {
+          throw error
+        }
       }
+      inflight = this.inflightRequests.get(memoizeKey)
     }
 
-    const headers = {
-      ...(this.globalRequestOptions?.headers || {}),
-      ...request.headers,
+    this.cacheMiss(request, memoizeKey, 'memoize')
+
+    const pending = this.dedupeRequest<TResult>(request, cacheKey, memoizeKey)
+    this.inflightRequests.set(memoizeKey, pending)
+
+    try {
+      return await pending
+    } finally {
+      this.inflightRequests.delete(memoizeKey)
+    }
+  }
+
+  /**
+   * Joins an identical GET request of an instance of the same datasource class which was started
+   * less than **dedupeWindowMs** ago and is still in flight. Requests are identical by cache key,
+   * headers and the options which affect the response. The response or error is shared with all
+   * callers and the entry is removed when the request settles.
+   */
+  private async dedupeRequest<TResult>(
+    request: Request,
+    cacheKey: string,
+    memoizeKey: string,
+  ): Promise<Response<TResult>> {
+    const headers = this.mergeRequestHeaders(request)
+
+    // an abort of the first caller must not reject the other callers, a token of the auth
+    // provider and a function deciding the status of the response can't be compared and a
+    // prefetch reports whether it stored the response itself
+    const dedupeWindowMs = this.options?.dedupeWindowMs
+    if (
+      !dedupeWindowMs ||
+      request.method !== 'GET' ||
+      request.responseType === 'stream' ||
+      request.signal ||
+      request.validateStatus ||
+      this.options?.authProvider ||
+      this.prefetches.has(request)
+    ) {
+      return this.fetchResponse<TResult>(request, cacheKey, memoizeKey, headers)
+    }
+
+    const requests = sharedRequests.get(this.constructor) ?? new Map()
+    sharedRequests.set(this.constructor, requests)
+
+    const key = JSON.stringify([
+      cacheKey,
+      request.responseType,
+      request.maxResponseSize ?? this.options?.maxResponseSize,
+      request.maxCompressedResponseSize ?? this.options?.maxCompressedResponseSize,
+      request.decompress ?? this.options?.decompress,
+      // the headers which are injected by the datasource differ by request
+      Object.keys(headers)
+        .filter((name) => !dedupeIgnoredHeaders.includes(name.toLowerCase()))
+        .map((name) => `${name.toLowerCase()}:${headers[name]}`)
+        .sort(),
+    ])
+
+    const shared = requests.get(key)
+    if (shared) {
+      // the response was received from the upstream, not from a cache
+      const response = await shared
+      return { ...response, timings: response.timings && { ...response.timings } }
+    }
+
+    const pending = this.fetchResponse<TResult>(request, cacheKey, memoizeKey, headers)
+    requests.set(key, pending)
+
+    const release = () => {
+      clearTimeout(timer)
+      // the window may have expired and another request has taken over the key
+      if (requests.get(key) === pending) {
+        requests.delete(key)
+      }
     }
+    const timer = setTimeout(release, dedupeWindowMs)
+    timer.unref()
+    pending.then(release, release)
+
+    return pending
+  }
 
+  /**
+   * Merges the **defaultHeaders**, the headers of the global requestOptions and of the request.
+   */
+  private mergeRequestHeaders(request: Request): Dictionary<string> {
+    const defaultHeaders = this.options?.defaultHeaders
+    return mergeHeaders(
+      typeof defaultHeaders === 'function' ? defaultHeaders(request) : defaultHeaders,
+      this.globalRequestOptions?.headers,
+      request.headers,
+    )
+  }
+
+  private async fetchResponse<TResult>(
+    request: Request,
+    cacheKey: string,
+    memoizeKey: string,
+    headers: Dictionary<string>,
+  ): Promise<Response<TResult>> {
     const options = {
       ...request,
-      ...this.globalRequestOptions,
       headers,
     }
 
-    const requestIsCacheable = this.isRequestCacheable(request)
+    // a prefetch fills the cache and is never answered from it
+    const prefetch = this.prefetches.get(request)
+    if (prefetch) {
+      this.prefetches.set(options, prefetch)
+      return this.performRequest<TResult>(options, cacheKey, memoizeKey)
+    }
+
+    // a stream is consumable once and is never answered from the cache
+    const requestIsCacheable =
+      request.responseType !== 'stream' && this.isRequestCacheable(request)
 
     if (requestIsCacheable) {
       // try to fetch from shared cache
-      if (request.requestCache) {
+      if (request.requestCache || this.options?.respectCacheControl) {
         try {
           const cacheItem = await this.cache.get(cacheKey)
           if (cacheItem) {
-            const cachedResponse: Response<TResult> = JSON.parse(cacheItem)
+            const cachedResponse = this.parseCacheItem<TResult>(cacheItem)
             cachedResponse.memoized = false
             cachedResponse.isFromCache = true
+            cachedResponse.timings = this.getCacheTimings()
+            this.cacheHit(request, cacheKey, 'requestCache')
             return cachedResponse
           }
-          const response = this.performRequest<TResult>(options, cacheKey)
+
+          // respond with the stale result and refresh the cache in the background
+          if (request.requestCache?.swr) {
+            const staleItem = await this.cache.get(
+              this.getCacheItemKey(request, cacheKey, 'staleWhileRevalidate'),
+            )
+            if (staleItem) {
+              const staleResponse = this.parseCacheItem<TResult>(staleItem)
+              staleResponse.memoized = false
+              staleResponse.isFromCache = true
+              staleResponse.isStale = true
+              staleResponse.timings = this.getCacheTimings()
+              this.cacheHit(request, cacheKey, 'requestCache')
+              this.revalidate(options, cacheKey, memoizeKey)
+              return staleResponse
+            }
+          }
+
+          this.cacheMiss(request, cacheKey, 'requestCache')
+
+          // send a conditional request to revalidate the expired response
+          if (request.requestCache?.revalidate) {
+            const revalidateItem = await this.cache.get(
+              this.getCacheItemKey(request, cacheKey, 'revalidate'),
+            )
+            if (revalidateItem) {
+              const revalidatedResponse = this.parseCacheItem<TResult>(revalidateItem)
+              const etag = revalidatedResponse.headers['etag']
+              const lastModified = revalidatedResponse.headers['last-modified']
+              if (etag) {
+                options.headers['if-none-match'] = etag
+              }
+              if (lastModified) {
+                options.headers['if-modified-since'] = lastModified
+              }
+              return this.performRequest<TResult>(
+                options,
+                cacheKey,
+                memoizeKey,
+                revalidatedResponse,
+              )
+            }
+          }
+
+          const response = this.performRequest<TResult>(options, cacheKey, memoizeKey)
 
           return response
         } catch (error: any) {
-          this.logger?.error(`Cache item '${cacheKey}' could not be loaded: ${error.message}`)
+          this.log('error', 'cache:getError', request, { cacheKey, error: error.message })
         }
       }
 
-      const response = this.performRequest<TResult>(options, cacheKey)
+      const response = this.performRequest<TResult>(options, cacheKey, memoizeKey)
 
       return response
     }
 
-    return this.performRequest<TResult>(options, cacheKey)
+    return this.performRequest<TResult>(options, cacheKey, memoizeKey)
   }
 }
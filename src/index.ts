@@ -6,7 +6,29 @@ export {
   Response,
   Request,
   RequestError,
+  RequestAbortedError,
+  RequestTimeoutError,
+  TooManyRedirectsError,
+  ResponseTooLargeError,
+  DataSourceClosedError,
+  PoolExhaustedError,
   CacheTTLOptions,
+  CacheSource,
+  ResponseType,
+  RetryOptions,
+  QueryValue,
+  QuerySerializer,
+  Span,
+  Tracer,
+  FormDataLike,
+  FormDataFile,
+  BatchRequest,
+  BatchOptions,
+  CookieJar,
+  RedactOptions,
+  AuthProvider,
+  PoolStats,
+  Timings,
 } from './http-data-source'
 
 export { ApolloError } from 'apollo-server-errors'
\ No newline at end of file
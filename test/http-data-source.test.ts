@@ -1,12 +1,36 @@
 import anyTest, { TestInterface } from 'ava'
 import http from 'http'
-import { createGzip, createDeflate, createBrotliCompress } from 'zlib'
+import {
+  createGzip,
+  createGunzip,
+  createDeflate,
+  createBrotliCompress,
+  gzipSync,
+  gunzipSync,
+} from 'zlib'
 import { Readable } from 'stream';
 import { setGlobalDispatcher, Agent, Pool } from 'undici'
 import AbortController from 'abort-controller'
 import querystring from 'querystring'
-import { HTTPDataSource, Request, Response, RequestError } from '../src'
+import {
+  HTTPDataSource,
+  Request,
+  RequestOptions,
+  Response,
+  RequestError,
+  RequestAbortedError,
+  RequestTimeoutError,
+  TooManyRedirectsError,
+  ResponseTooLargeError,
+  DataSourceClosedError,
+  PoolExhaustedError,
+  FormDataFile,
+  CacheSource,
+  QuerySerializer,
+  Tracer,
+} from '../src'
 import { AddressInfo } from 'net'
+import { URL } from 'url'
 import { KeyValueCacheSetOptions } from 'apollo-server-caching'
 import FakeTimers from '@sinonjs/fake-timers'
 
@@ -147,6 +171,63 @@ test('Should be able to make a simple POST with JSON body', async (t) => {
   t.deepEqual(response.body, { name: 'foo' })
 })
 
+test('Should compress the request body above the compression threshold', async (t) => {
+  t.plan(6)
+
+  const path = '/'
+
+  const wanted = { name: 'foo' }
+
+  const payload = { data: 'a'.repeat(2048) }
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'POST')
+
+    const chunks: Buffer[] = []
+    const body: Readable =
+      req.headers['content-encoding'] === 'gzip' ? req.pipe(createGunzip()) : req
+    body.on('data', (chunk) => chunks.push(chunk))
+    body.on('end', () => {
+      const expected = req.url === '/?small=true' ? { a: 1 } : payload
+      t.deepEqual(JSON.parse(Buffer.concat(chunks).toString()), expected)
+      res.writeHead(200, {
+        'content-type': 'application/json',
+        'x-content-encoding': req.headers['content-encoding'] ?? 'identity',
+      })
+      res.write(JSON.stringify(wanted))
+      res.end()
+      res.socket?.unref()
+    })
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    postFoo(body: unknown, small: boolean) {
+      return this.post(path, {
+        body,
+        query: {
+          small,
+        },
+        compression: 'gzip',
+      })
+    }
+  })()
+
+  let response = await dataSource.postFoo(payload, false)
+  t.is(response.headers['x-content-encoding'], 'gzip')
+
+  response = await dataSource.postFoo({ a: 1 }, true)
+  t.is(response.headers['x-content-encoding'], 'identity')
+})
+
 test('Should be able to make a simple DELETE call', async (t) => {
   t.plan(2)
 
@@ -258,6 +339,90 @@ test('Should be able to make a simple PATCH call', async (t) => {
   t.deepEqual(response.body, { name: 'foo' })
 })
 
+test('Should be able to make a simple HEAD call', async (t) => {
+  t.plan(7)
+
+  const path = '/'
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'HEAD')
+    res.writeHead(200, {
+      'content-type': 'application/json',
+      'content-length': '13',
+      etag: '"foo"',
+    })
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    headFoo() {
+      return this.head(path)
+    }
+  })()
+
+  let response = await dataSource.headFoo()
+
+  t.is(response.statusCode, 200)
+  t.is(response.headers['content-length'], '13')
+  t.is(response.headers['etag'], '"foo"')
+  t.is(response.body, undefined)
+  t.false(response.memoized)
+
+  response = await dataSource.headFoo()
+
+  t.true(response.memoized)
+})
+
+test('Should not decompress the empty body of a HEAD or 204 response', async (t) => {
+  t.plan(4)
+
+  const server = http.createServer((req, res) => {
+    res.writeHead(req.method === 'HEAD' ? 200 : 204, {
+      'content-encoding': 'gzip',
+    })
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    headFoo() {
+      return this.head('/')
+    }
+    deleteFoo() {
+      return this.delete('/')
+    }
+  })()
+
+  let response = await dataSource.headFoo()
+
+  t.is(response.statusCode, 200)
+  t.is(response.body, undefined)
+
+  response = await dataSource.deleteFoo()
+
+  t.is(response.statusCode, 204)
+  t.falsy(response.body)
+})
+
 test('Should be able to pass query params', async (t) => {
   t.plan(3)
 
@@ -355,16 +520,21 @@ test('Should error on HTTP errors > 299 and != 304', async (t) => {
   )
 })
 
-test('Should not parse content as JSON when content-type header is missing', async (t) => {
-  t.plan(3)
+test('Should retry responses with a retryable status code', async (t) => {
+  t.plan(5)
 
   const path = '/'
 
   const wanted = { name: 'foo' }
 
+  let reqCount = 0
+
   const server = http.createServer((req, res) => {
     t.is(req.method, 'GET')
-    res.writeHead(200)
+    reqCount++
+    res.writeHead(reqCount < 3 ? 409 : 200, {
+      'content-type': 'application/json',
+    })
     res.write(JSON.stringify(wanted))
     res.end()
     res.socket?.unref()
@@ -381,29 +551,35 @@ test('Should not parse content as JSON when content-type header is missing', asy
       super(baseURL)
     }
     getFoo() {
-      return this.get(path)
+      return this.get(path, {
+        retry: {
+          maxRetries: 2,
+          delay: 1,
+          retryableStatusCodes: [409],
+        },
+      })
     }
   })()
 
   const response = await dataSource.getFoo()
+
   t.is(response.statusCode, 200)
-  t.is(response.body, JSON.stringify(wanted))
+  t.deepEqual(response.body, wanted)
 })
 
-test('Should memoize subsequent GET calls to the same endpoint', async (t) => {
-  t.plan(17)
+test('Should execute onRetry before every retry but not for the last failure', async (t) => {
+  t.plan(12)
 
   const path = '/'
 
-  const wanted = { name: 'foo' }
+  let reqCount = 0
 
   const server = http.createServer((req, res) => {
     t.is(req.method, 'GET')
-    res.writeHead(200, {
-      'content-type': 'application/json',
-    })
-    res.write(JSON.stringify(wanted))
-    setTimeout(() => res.end(), 50).unref()
+    t.is(req.headers['x-retry-attempt'], reqCount === 0 ? undefined : String(reqCount))
+    reqCount++
+    res.writeHead(503)
+    res.end()
     res.socket?.unref()
   })
 
@@ -418,51 +594,38 @@ test('Should memoize subsequent GET calls to the same endpoint', async (t) => {
       super(baseURL)
     }
     getFoo() {
-      return this.get(path)
+      return this.get(path, {
+        retry: {
+          maxRetries: 2,
+          delay: 1,
+          jitter: 'none',
+        },
+      })
+    }
+    onRetry(error: Error, request: Request, attempt: number, delay: number) {
+      t.true(error instanceof RequestError)
+      t.is(delay, 2 ** (attempt - 1))
+      request.headers['x-retry-attempt'] = String(attempt)
+    }
+    onError() {
+      t.pass()
     }
   })()
 
-  let response = await dataSource.getFoo()
-  t.deepEqual(response.body, wanted)
-  t.false(response.isFromCache)
-  t.false(response.memoized)
-  t.falsy(response.maxTtl)
-
-  response = await dataSource.getFoo()
-  t.deepEqual(response.body, wanted)
-  t.false(response.isFromCache)
-  t.true(response.memoized)
-  t.falsy(response.maxTtl)
-
-  response = await dataSource.getFoo()
-  t.deepEqual(response.body, wanted)
-  t.false(response.isFromCache)
-  t.true(response.memoized)
-  t.falsy(response.maxTtl)
-
-  response = await dataSource.getFoo()
-  t.deepEqual(response.body, wanted)
-  t.false(response.isFromCache)
-  t.true(response.memoized)
-  t.falsy(response.maxTtl)
+  await t.throwsAsync(dataSource.getFoo(), {
+    code: 503,
+  })
 })
 
-test('Should memoize subsequent GET calls to the same endpoint when the memoize option is undefined', async (t) => {
-  t.plan(17)
+test('Should prefer shouldRetry over the retryable status codes', async (t) => {
+  t.plan(5)
 
   const path = '/'
 
-  const MAX_SUBSEQUENT_CALLS = 3
-
-  const wanted = { name: 'foo' }
-
   const server = http.createServer((req, res) => {
     t.is(req.method, 'GET')
-    res.writeHead(200, {
-      'content-type': 'application/json',
-    })
-    res.write(JSON.stringify(wanted))
-    setTimeout(() => res.end(), 50).unref()
+    res.writeHead(502)
+    res.end()
     res.socket?.unref()
   })
 
@@ -477,42 +640,73 @@ test('Should memoize subsequent GET calls to the same endpoint when the memoize
       super(baseURL)
     }
     getFoo() {
-      return this.get(path)
+      return this.get(path, {
+        retry: {
+          maxRetries: 3,
+          delay: 1,
+          retryableStatusCodes: [502],
+          shouldRetry(error: Error, _request: Request, attempt: number) {
+            t.true(error instanceof RequestError)
+            return attempt < 2
+          },
+        },
+      })
     }
   })()
 
-  const firstCall = await dataSource.getFoo()
-  t.deepEqual(firstCall.body, wanted)
-  t.false(firstCall.isFromCache)
-  t.false(firstCall.memoized)
-  t.falsy(firstCall.maxTtl)
+  await t.throwsAsync(dataSource.getFoo(), {
+    code: 502,
+    message: 'Response code 502 (Bad Gateway)',
+  })
+})
 
-  for (let currentCall = 0; currentCall < MAX_SUBSEQUENT_CALLS; currentCall++) {
-    const subsequentCall = await dataSource.getFoo()
+test('Should randomize the retry delay and respect the Retry-After header', async (t) => {
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super('http://localhost')
+    }
+    getDelay(jitter: 'none' | 'full' | 'equal', attempt: number, error = new Error('Failed')) {
+      const request = { path: '/', retry: { maxRetries: 3, delay: 100, jitter } } as Request
+      return this.getRetryDelay(error, request, attempt)
+    }
+  })()
 
-    t.deepEqual(subsequentCall.body, wanted)
-    t.false(subsequentCall.isFromCache)
-    t.true(subsequentCall.memoized)
-    t.falsy(subsequentCall.maxTtl)
+  t.is(dataSource.getDelay('none', 3), 400)
+
+  for (let i = 0; i < 20; i++) {
+    const fullDelay = dataSource.getDelay('full', 2)
+    t.true(fullDelay >= 0 && fullDelay <= 200)
+    const equalDelay = dataSource.getDelay('equal', 2)
+    t.true(equalDelay >= 100 && equalDelay <= 200)
   }
+
+  const error = new RequestError('Service Unavailable', 503, {} as Request, {
+    headers: { 'retry-after': '2' },
+  } as unknown as Response<unknown>)
+
+  t.is(dataSource.getDelay('full', 1, error), 2000)
+
+  // only 429 and 503 responses announce when to retry
+  const serverError = new RequestError('Internal Server Error', 500, {} as Request, {
+    headers: { 'retry-after': '2' },
+  } as unknown as Response<unknown>)
+
+  t.is(dataSource.getDelay('none', 1, serverError), 100)
 })
 
-test('Should memoize subsequent GET calls to the same endpoint when the memoize option is true', async (t) => {
-  t.plan(17)
+test('Should cap the Retry-After header at maxRetryAfter', async (t) => {
+  t.plan(4)
 
   const path = '/'
 
-  const MAX_SUBSEQUENT_CALLS = 3
-
-  const wanted = { name: 'foo' }
+  let reqCount = 0
 
   const server = http.createServer((req, res) => {
     t.is(req.method, 'GET')
-    res.writeHead(200, {
-      'content-type': 'application/json',
+    res.writeHead(++reqCount < 2 ? 503 : 200, {
+      'retry-after': '120',
     })
-    res.write(JSON.stringify(wanted))
-    setTimeout(() => res.end(), 50).unref()
+    res.end()
     res.socket?.unref()
   })
 
@@ -527,42 +721,33 @@ test('Should memoize subsequent GET calls to the same endpoint when the memoize
       super(baseURL)
     }
     getFoo() {
-      return this.get(path, { memoize: true })
+      return this.get(path, {
+        retry: {
+          maxRetries: 1,
+          maxRetryAfter: 10,
+        },
+      })
     }
   })()
 
-  const firstCall = await dataSource.getFoo()
-  t.deepEqual(firstCall.body, wanted)
-  t.false(firstCall.isFromCache)
-  t.false(firstCall.memoized)
-  t.falsy(firstCall.maxTtl)
-
-  for (let currentCall = 0; currentCall < MAX_SUBSEQUENT_CALLS; currentCall++) {
-    const subsequentCall = await dataSource.getFoo()
+  const response = await dataSource.getFoo()
 
-    t.deepEqual(subsequentCall.body, wanted)
-    t.false(subsequentCall.isFromCache)
-    t.true(subsequentCall.memoized)
-    t.falsy(subsequentCall.maxTtl)
-  }
+  t.is(response.statusCode, 200)
+  t.is(reqCount, 2)
 })
 
-test('Should not memoize subsequent GET calls to the same endpoint when the memoize option is false', async (t) => {
-  t.plan(15)
+test('Should not parse content as JSON when content-type header is missing', async (t) => {
+  t.plan(3)
 
   const path = '/'
 
-  const MAX_CALLS = 3
-
   const wanted = { name: 'foo' }
 
   const server = http.createServer((req, res) => {
     t.is(req.method, 'GET')
-    res.writeHead(200, {
-      'content-type': 'application/json',
-    })
+    res.writeHead(200)
     res.write(JSON.stringify(wanted))
-    setTimeout(() => res.end(), 50).unref()
+    res.end()
     res.socket?.unref()
   })
 
@@ -577,35 +762,101 @@ test('Should not memoize subsequent GET calls to the same endpoint when the memo
       super(baseURL)
     }
     getFoo() {
-      return this.get(path, { memoize: false })
+      return this.get(path)
     }
   })()
 
-  for (let currentCall = 0; currentCall < MAX_CALLS; currentCall++) {
-    const subsequentCall = await dataSource.getFoo()
+  const response = await dataSource.getFoo()
+  t.is(response.statusCode, 200)
+  t.is(response.body, JSON.stringify(wanted))
+})
 
-    t.deepEqual(subsequentCall.body, wanted)
-    t.false(subsequentCall.isFromCache)
-    t.false(subsequentCall.memoized)
-    t.falsy(subsequentCall.maxTtl)
+test('Should pass the raw body as Buffer when responseType is arraybuffer', async (t) => {
+  t.plan(7)
+
+  const path = '/'
+
+  const wanted = Buffer.from([0xde, 0xad, 0xbe, 0xef])
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(200, {
+      'content-type': 'application/octet-stream',
+    })
+    res.write(wanted)
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  class DataSource extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    getFoo() {
+      return this.get<Buffer>(path, {
+        responseType: 'arraybuffer',
+        requestCache: {
+          maxTtl: 10,
+          maxTtlIfError: 20,
+        },
+      })
+    }
+  }
+
+  const cacheMap = new Map<string, string>()
+  const datasSourceConfig = {
+    context: {
+      a: 1,
+    },
+    cache: {
+      async delete(key: string) {
+        return cacheMap.delete(key)
+      },
+      async get(key: string) {
+        return cacheMap.get(key)
+      },
+      async set(key: string, value: string) {
+        cacheMap.set(key, value)
+      },
+    },
   }
+
+  let dataSource = new DataSource()
+  dataSource.initialize(datasSourceConfig)
+
+  let response = await dataSource.getFoo()
+  t.true(Buffer.isBuffer(response.body))
+  t.deepEqual(response.body, wanted)
+  t.is(cacheMap.size, 2)
+
+  // the body is stored base64 encoded
+  dataSource = new DataSource()
+  dataSource.initialize(datasSourceConfig)
+
+  response = await dataSource.getFoo()
+  t.true(response.isFromCache)
+  t.true(Buffer.isBuffer(response.body))
+  t.deepEqual(response.body, wanted)
 })
 
-test('Should not memoize subsequent GET calls for unsuccessful responses', async (t) => {
-  t.plan(17)
+test('Should error when responseType is json and the response is not JSON', async (t) => {
+  t.plan(2)
 
   const path = '/'
 
-  const wanted = { name: 'foo' }
-
   const server = http.createServer((req, res) => {
-    const queryObject = querystring.parse(req.url?.replace('/?', '')!)
     t.is(req.method, 'GET')
-    res.writeHead(queryObject['statusCode'] as unknown as number, {
-      'content-type': 'application/json',
+    res.writeHead(200, {
+      'content-type': 'text/csv',
     })
-    res.write(JSON.stringify(wanted))
-    setTimeout(() => res.end(), 50).unref()
+    res.write('a,b,c')
+    res.end()
     res.socket?.unref()
   })
 
@@ -619,43 +870,21 @@ test('Should not memoize subsequent GET calls for unsuccessful responses', async
     constructor() {
       super(baseURL)
     }
-    onError(error: Error) {
-      if (error instanceof RequestError) {
-        t.false(error.response.isFromCache)
-        t.false(error.response.memoized)
-        t.falsy(error.response.maxTtl)
-        t.truthy(error.request)
-      }
-    }
-    getFoo(statusCode: number) {
+    getFoo() {
       return this.get(path, {
-        query: {
-          statusCode,
-        },
+        responseType: 'json',
       })
     }
   })()
 
-  let response = await dataSource.getFoo(300)
-  t.deepEqual(response.body, { name: 'foo' })
-  t.false(response.isFromCache)
-  t.false(response.memoized)
-  t.falsy(response.maxTtl)
-
-  await t.throwsAsync(dataSource.getFoo(401), {
-    instanceOf: Error,
-    code: 401,
-    message: 'Response code 401 (Unauthorized)',
-  })
-  await t.throwsAsync(dataSource.getFoo(500), {
-    instanceOf: Error,
-    code: 500,
-    message: 'Response code 500 (Internal Server Error)',
+  await t.throwsAsync(dataSource.getFoo(), {
+    instanceOf: RequestError,
+    message: "Expected a JSON response but received content-type 'text/csv'",
   })
 })
 
-test('Should be able to define a custom cache key for request memoization', async (t) => {
-  t.plan(7)
+test('Should memoize subsequent GET calls to the same endpoint', async (t) => {
+  t.plan(17)
 
   const path = '/'
 
@@ -667,7 +896,7 @@ test('Should be able to define a custom cache key for request memoization', asyn
       'content-type': 'application/json',
     })
     res.write(JSON.stringify(wanted))
-    res.end()
+    setTimeout(() => res.end(), 50).unref()
     res.socket?.unref()
   })
 
@@ -681,11 +910,6 @@ test('Should be able to define a custom cache key for request memoization', asyn
     constructor() {
       super(baseURL)
     }
-    onCacheKeyCalculation(request: Request) {
-      t.pass('onCacheKeyCalculation')
-      t.truthy(request)
-      return 'foo'
-    }
     getFoo() {
       return this.get(path)
     }
@@ -693,26 +917,45 @@ test('Should be able to define a custom cache key for request memoization', asyn
 
   let response = await dataSource.getFoo()
   t.deepEqual(response.body, wanted)
+  t.false(response.isFromCache)
+  t.false(response.memoized)
+  t.falsy(response.maxTtl)
+
+  response = await dataSource.getFoo()
+  t.deepEqual(response.body, wanted)
+  t.false(response.isFromCache)
+  t.true(response.memoized)
+  t.falsy(response.maxTtl)
+
+  response = await dataSource.getFoo()
+  t.deepEqual(response.body, wanted)
+  t.false(response.isFromCache)
+  t.true(response.memoized)
+  t.falsy(response.maxTtl)
 
   response = await dataSource.getFoo()
   t.deepEqual(response.body, wanted)
+  t.false(response.isFromCache)
+  t.true(response.memoized)
+  t.falsy(response.maxTtl)
 })
 
-test('Should correctly calculate and sort query parameters', async (t) => {
-  t.plan(3)
+test('Should memoize subsequent GET calls to the same endpoint when the memoize option is undefined', async (t) => {
+  t.plan(17)
 
   const path = '/'
 
+  const MAX_SUBSEQUENT_CALLS = 3
+
   const wanted = { name: 'foo' }
 
   const server = http.createServer((req, res) => {
     t.is(req.method, 'GET')
-    t.is(req.url, '/?a=1&b=2&z=z')
     res.writeHead(200, {
       'content-type': 'application/json',
     })
     res.write(JSON.stringify(wanted))
-    res.end()
+    setTimeout(() => res.end(), 50).unref()
     res.socket?.unref()
   })
 
@@ -727,29 +970,42 @@ test('Should correctly calculate and sort query parameters', async (t) => {
       super(baseURL)
     }
     getFoo() {
-      return this.get(path, {
-        query: {
-          b: 2,
-          a: 1,
-          z: 'z',
-        },
-      })
+      return this.get(path)
     }
   })()
 
-  let response = await dataSource.getFoo()
-  t.deepEqual(response.body, wanted)
+  const firstCall = await dataSource.getFoo()
+  t.deepEqual(firstCall.body, wanted)
+  t.false(firstCall.isFromCache)
+  t.false(firstCall.memoized)
+  t.falsy(firstCall.maxTtl)
+
+  for (let currentCall = 0; currentCall < MAX_SUBSEQUENT_CALLS; currentCall++) {
+    const subsequentCall = await dataSource.getFoo()
+
+    t.deepEqual(subsequentCall.body, wanted)
+    t.false(subsequentCall.isFromCache)
+    t.true(subsequentCall.memoized)
+    t.falsy(subsequentCall.maxTtl)
+  }
 })
 
-test('Should call onError on request error', async (t) => {
-  t.plan(11)
+test('Should memoize subsequent GET calls to the same endpoint when the memoize option is true', async (t) => {
+  t.plan(17)
 
   const path = '/'
 
+  const MAX_SUBSEQUENT_CALLS = 3
+
+  const wanted = { name: 'foo' }
+
   const server = http.createServer((req, res) => {
     t.is(req.method, 'GET')
-    res.writeHead(500)
-    res.end()
+    res.writeHead(200, {
+      'content-type': 'application/json',
+    })
+    res.write(JSON.stringify(wanted))
+    setTimeout(() => res.end(), 50).unref()
     res.socket?.unref()
   })
 
@@ -763,50 +1019,43 @@ test('Should call onError on request error', async (t) => {
     constructor() {
       super(baseURL)
     }
-
-    onResponse<TResult = any>(request: Request, response: Response<TResult>) {
-      t.truthy(request)
-      t.truthy(response)
-      t.pass('onResponse')
-      return super.onResponse<TResult>(request, response)
+    getFoo() {
+      return this.get(path, { memoize: true })
     }
+  })()
 
-    onError(error: Error) {
-      t.is(error.name, 'RequestError')
-      t.is(error.message, 'Response code 500 (Internal Server Error)')
-      if (error instanceof RequestError) {
-        t.is(error.code, 500)
-        t.truthy(error.request)
-        t.truthy(error.response)
-      }
-      t.pass('onRequestError')
-    }
+  const firstCall = await dataSource.getFoo()
+  t.deepEqual(firstCall.body, wanted)
+  t.false(firstCall.isFromCache)
+  t.false(firstCall.memoized)
+  t.falsy(firstCall.maxTtl)
 
-    async getFoo() {
-      return await this.get(path)
-    }
-  })()
+  for (let currentCall = 0; currentCall < MAX_SUBSEQUENT_CALLS; currentCall++) {
+    const subsequentCall = await dataSource.getFoo()
 
-  await t.throwsAsync(
-    dataSource.getFoo(),
-    {
-      instanceOf: Error,
-      code: 500,
-      message: 'Response code 500 (Internal Server Error)',
-    },
-    'Server error',
-  )
+    t.deepEqual(subsequentCall.body, wanted)
+    t.false(subsequentCall.isFromCache)
+    t.true(subsequentCall.memoized)
+    t.falsy(subsequentCall.maxTtl)
+  }
 })
 
-test('Should be possible to pass a request context', async (t) => {
-  t.plan(3)
+test('Should not memoize subsequent GET calls to the same endpoint when the memoize option is false', async (t) => {
+  t.plan(15)
 
   const path = '/'
 
+  const MAX_CALLS = 3
+
+  const wanted = { name: 'foo' }
+
   const server = http.createServer((req, res) => {
     t.is(req.method, 'GET')
-    res.writeHead(200)
-    res.end()
+    res.writeHead(200, {
+      'content-type': 'application/json',
+    })
+    res.write(JSON.stringify(wanted))
+    setTimeout(() => res.end(), 50).unref()
     res.socket?.unref()
   })
 
@@ -820,40 +1069,33 @@ test('Should be possible to pass a request context', async (t) => {
     constructor() {
       super(baseURL)
     }
-
-    onResponse<TResult = any>(request: Request, response: Response<TResult>) {
-      t.deepEqual(request.context, { a: '1' })
-      t.pass('onResponse')
-      return super.onResponse<TResult>(request, response)
-    }
-
-    async getFoo() {
-      return await this.get(path, {
-        context: {
-          a: '1',
-        },
-      })
+    getFoo() {
+      return this.get(path, { memoize: false })
     }
   })()
 
-  await dataSource.getFoo()
-})
+  for (let currentCall = 0; currentCall < MAX_CALLS; currentCall++) {
+    const subsequentCall = await dataSource.getFoo()
 
-test.cb('Should abort request when abortController signal is called', (t) => {
-  t.plan(2)
+    t.deepEqual(subsequentCall.body, wanted)
+    t.false(subsequentCall.isFromCache)
+    t.false(subsequentCall.memoized)
+    t.falsy(subsequentCall.maxTtl)
+  }
+})
 
-  const path = '/'
+test('Should interpolate the path parameters', async (t) => {
+  t.plan(6)
 
-  const server = http
-    .createServer((req, res) => {
-      t.is(req.method, 'GET')
-      setTimeout(() => {
-        res.writeHead(200)
-        res.end()
-        res.socket?.unref()
-      }, 50)
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(200, {
+      'content-type': 'application/json',
     })
-    .unref()
+    res.write(JSON.stringify({ url: req.url }))
+    res.end()
+    res.socket?.unref()
+  })
 
   t.teardown(server.close.bind(server))
 
@@ -861,55 +1103,48 @@ test.cb('Should abort request when abortController signal is called', (t) => {
 
   const baseURL = getBaseUrlOf(server)
 
-  const abortController = new AbortController()
-
   const dataSource = new (class extends HTTPDataSource {
     constructor() {
       super(baseURL)
     }
-
-    async getFoo() {
-      return await this.get(path, {
-        signal: abortController.signal,
+    getPost(params: Record<string, string | number>) {
+      return this.get('/users/:id/posts/:postId:publish', {
+        params,
+        query: {
+          a: 1,
+        },
       })
     }
   })()
 
-  t.throwsAsync(
-    async () => {
-      try {
-        await dataSource.getFoo()
-        t.fail()
-      } catch (error) {
-        t.pass('Throw error')
-        throw error
-      }
-    },
-    {
-      instanceOf: Error,
-      message: 'Request aborted',
-    },
-    'Timeout',
-  ).finally(t.end)
+  let response = await dataSource.getPost({ id: 'a/b c', postId: 1 })
+  t.deepEqual(response.body, { url: '/users/a%2Fb%20c/posts/1:publish?a=1' })
 
-  abortController.abort()
+  response = await dataSource.getPost({ id: 'd', postId: 1 })
+  t.deepEqual(response.body, { url: '/users/d/posts/1:publish?a=1' })
+  t.false(response.memoized)
+
+  await t.throwsAsync(dataSource.getPost({ id: 'd' }), {
+    message: "Missing path parameter 'postId' of the path: /users/:id/posts/:postId:publish",
+  })
 })
 
-test.cb('Should timeout because server does not respond fast enough', (t) => {
-  t.plan(3)
+test('Should memoize POST calls with equivalent JSON bodies when the memoize option is true', async (t) => {
+  t.plan(7)
 
   const path = '/'
 
-  const server = http
-    .createServer((req, res) => {
-      t.is(req.method, 'GET')
-      setTimeout(() => {
-        res.writeHead(200)
-        res.end()
-        res.socket?.unref()
-      }, 100)
+  const wanted = { name: 'foo' }
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'POST')
+    res.writeHead(200, {
+      'content-type': 'application/json',
     })
-    .unref()
+    res.write(JSON.stringify(wanted))
+    res.end()
+    res.socket?.unref()
+  })
 
   t.teardown(server.close.bind(server))
 
@@ -919,51 +1154,47 @@ test.cb('Should timeout because server does not respond fast enough', (t) => {
 
   const dataSource = new (class extends HTTPDataSource {
     constructor() {
-      super(baseURL, {
-        clientOptions: {
-          bodyTimeout: 50,
-          headersTimeout: 50,
-        },
-      })
+      super(baseURL)
     }
-
-    async getFoo() {
-      return await this.get(path)
+    postFoo(body: unknown) {
+      return this.post(path, {
+        body,
+        memoize: true,
+      })
     }
   })()
 
-  t.throwsAsync(
-    async () => {
-      try {
-        await dataSource.getFoo()
-        t.fail()
-      } catch (error) {
-        t.pass('Throw error')
-        throw error
-      }
-    },
-    {
-      instanceOf: Error,
-      message: 'Headers Timeout Error',
-    },
-    'Timeout',
-  ).finally(t.end)
-})
+  let response = await dataSource.postFoo({ query: 'foo', variables: { a: 1, b: 2 } })
+  t.deepEqual(response.body, wanted)
+  t.false(response.memoized)
 
-test('Should be able to modify request in willSendRequest', async (t) => {
-  t.plan(3)
+  response = await dataSource.postFoo({ variables: { b: 2, a: 1 }, query: 'foo' })
+  t.true(response.memoized)
 
-  const path = '/'
+  response = await dataSource.postFoo({ query: 'bar' })
+  t.false(response.memoized)
 
-  const wanted = { name: 'foo' }
+  await t.throwsAsync(dataSource.postFoo(Readable.from(['foo'])), {
+    message: "A request with a stream body can't be memoized: /",
+  })
+})
 
-  const server = http.createServer((req, res) => {
-    t.is(req.method, 'GET')
-    t.deepEqual(req.headers['x-foo'], 'bar')
+test('Should send the body of GET and DELETE requests and memoize GET calls by body', async (t) => {
+  t.plan(14)
+
+  const path = '/_search'
+
+  const server = http.createServer(async (req, res) => {
+    t.is(req.headers['content-type'], 'application/json; charset=utf-8')
+    const chunks: Buffer[] = []
+    for await (const chunk of req) {
+      chunks.push(chunk)
+    }
     res.writeHead(200, {
       'content-type': 'application/json',
     })
-    res.write(JSON.stringify(wanted))
+    const body = JSON.parse(Buffer.concat(chunks).toString())
+    res.write(JSON.stringify({ method: req.method, body }))
     res.end()
     res.socket?.unref()
   })
@@ -978,36 +1209,54 @@ test('Should be able to modify request in willSendRequest', async (t) => {
     constructor() {
       super(baseURL)
     }
-    async onRequest(request: Request) {
-      request.headers = {
-        'X-Foo': 'bar',
-      }
+    search(body: unknown) {
+      return this.get(path, {
+        body,
+      })
     }
-    getFoo() {
-      return this.get(path)
+    deleteByQuery(body: unknown) {
+      return this.delete(path, {
+        body,
+      })
     }
   })()
 
-  const response = await dataSource.getFoo()
+  let response = await dataSource.search({ query: 'foo' })
+  t.deepEqual(response.body, { method: 'GET', body: { query: 'foo' } })
+  t.false(response.memoized)
 
-  t.deepEqual(response.body, wanted)
+  response = await dataSource.search({ query: 'bar' })
+  t.deepEqual(response.body, { method: 'GET', body: { query: 'bar' } })
+  t.false(response.memoized)
+
+  response = await dataSource.search({ query: 'foo' })
+  t.deepEqual(response.body, { method: 'GET', body: { query: 'foo' } })
+  t.true(response.memoized)
+
+  response = await dataSource.deleteByQuery({ query: 'foo' })
+  t.deepEqual(response.body, { method: 'DELETE', body: { query: 'foo' } })
+  t.false(response.memoized)
+
+  response = await dataSource.deleteByQuery({ query: 'foo' })
+  t.deepEqual(response.body, { method: 'DELETE', body: { query: 'foo' } })
+  t.false(response.memoized)
 })
 
-test('Should be able to define base headers for every request', async (t) => {
-  t.plan(4)
+test('Should not memoize subsequent GET calls for unsuccessful responses', async (t) => {
+  t.plan(17)
 
   const path = '/'
 
   const wanted = { name: 'foo' }
 
   const server = http.createServer((req, res) => {
+    const queryObject = querystring.parse(req.url?.replace('/?', '')!)
     t.is(req.method, 'GET')
-    t.deepEqual(req.headers['x-foo'], 'bar')
-    res.writeHead(200, {
+    res.writeHead(queryObject['statusCode'] as unknown as number, {
       'content-type': 'application/json',
     })
     res.write(JSON.stringify(wanted))
-    res.end()
+    setTimeout(() => res.end(), 50).unref()
     res.socket?.unref()
   })
 
@@ -1019,31 +1268,45 @@ test('Should be able to define base headers for every request', async (t) => {
 
   const dataSource = new (class extends HTTPDataSource {
     constructor() {
-      super(baseURL, {
-        requestOptions: {
-          headers: {
-            'X-Foo': 'bar',
-          },
-        },
-      })
+      super(baseURL)
     }
-    async onRequest(request: Request) {
-      t.deepEqual(request.headers, {
-        'X-Foo': 'bar',
-      })
+    onError(error: Error) {
+      if (error instanceof RequestError) {
+        t.false(error.response.isFromCache)
+        t.false(error.response.memoized)
+        t.falsy(error.response.maxTtl)
+        t.truthy(error.request)
+      }
     }
-    getFoo() {
-      return this.get(path)
+    getFoo(statusCode: number) {
+      return this.get(path, {
+        query: {
+          statusCode,
+        },
+      })
     }
   })()
 
-  const response = await dataSource.getFoo()
+  let response = await dataSource.getFoo(300)
+  t.deepEqual(response.body, { name: 'foo' })
+  t.false(response.isFromCache)
+  t.false(response.memoized)
+  t.falsy(response.maxTtl)
 
-  t.deepEqual(response.body, wanted)
+  await t.throwsAsync(dataSource.getFoo(401), {
+    instanceOf: Error,
+    code: 401,
+    message: 'Response code 401 (Unauthorized)',
+  })
+  await t.throwsAsync(dataSource.getFoo(500), {
+    instanceOf: Error,
+    code: 500,
+    message: 'Response code 500 (Internal Server Error)',
+  })
 })
 
-test('Initialize data source with cache and context', async (t) => {
-  t.plan(3)
+test('Should be able to define a custom cache key for request memoization', async (t) => {
+  t.plan(7)
 
   const path = '/'
 
@@ -1069,40 +1332,25 @@ test('Initialize data source with cache and context', async (t) => {
     constructor() {
       super(baseURL)
     }
+    onCacheKeyCalculation(request: Request) {
+      t.pass('onCacheKeyCalculation')
+      t.truthy(request)
+      return 'foo'
+    }
     getFoo() {
-      t.deepEqual(this.context, {
-        a: 1,
-      })
       return this.get(path)
     }
   })()
 
-  const cacheMap = new Map<string, string>()
-
-  dataSource.initialize({
-    context: {
-      a: 1,
-    },
-    cache: {
-      async delete(key: string) {
-        return cacheMap.delete(key)
-      },
-      async get(key: string) {
-        return cacheMap.get(key)
-      },
-      async set(key: string, value: string) {
-        cacheMap.set(key, value)
-      },
-    },
-  })
-
-  const response = await dataSource.getFoo()
+  let response = await dataSource.getFoo()
+  t.deepEqual(response.body, wanted)
 
+  response = await dataSource.getFoo()
   t.deepEqual(response.body, wanted)
 })
 
-test('Should cache a GET response and respond with the result on subsequent calls', async (t) => {
-  t.plan(15)
+test('Should dedupe concurrent requests by the key of onMemoizeKeyCalculation', async (t) => {
+  t.plan(7)
 
   const path = '/'
 
@@ -1124,115 +1372,3116 @@ test('Should cache a GET response and respond with the result on subsequent call
 
   const baseURL = getBaseUrlOf(server)
 
-  let dataSource = new (class extends HTTPDataSource {
+  const dataSource = new (class extends HTTPDataSource {
     constructor() {
       super(baseURL)
     }
-    getFoo() {
+    onMemoizeKeyCalculation(request: Request) {
+      return request.path.replace(/[?&]t=\d+/, '') + request.headers['x-locale']
+    }
+    getFoo(timestamp: number, locale: string) {
       return this.get(path, {
-        requestCache: {
-          maxTtl: 10,
-          maxTtlIfError: 20,
+        query: {
+          t: timestamp,
+        },
+        headers: {
+          'x-locale': locale,
         },
       })
     }
   })()
 
-  const cacheMap = new Map<string, string>()
-  const datasSourceConfig = {
-    context: {
-      a: 1,
-    },
-    cache: {
-      async delete(key: string) {
-        return cacheMap.delete(key)
-      },
-      async get(key: string) {
-        return cacheMap.get(key)
-      },
-      async set(key: string, value: string) {
+  const [first, second, third] = await Promise.all([
+    dataSource.getFoo(1, 'en'),
+    dataSource.getFoo(2, 'en'),
+    dataSource.getFoo(3, 'de'),
+  ])
+
+  t.deepEqual(first.body, wanted)
+  t.false(first.memoized)
+  t.true(second.memoized)
+  t.false(third.memoized)
+  t.deepEqual(third.body, wanted)
+})
+
+test('Should share a GET request in flight across datasource instances within dedupeWindowMs', async (t) => {
+  t.plan(6)
+
+  const path = '/'
+
+  const wanted = { name: 'foo' }
+
+  let requests = 0
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    requests++
+    res.writeHead(requests === 1 ? 200 : 500, {
+      'content-type': 'application/json',
+    })
+    res.write(JSON.stringify(wanted))
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  class DataSource extends HTTPDataSource {
+    constructor() {
+      super(baseURL, {
+        dedupeWindowMs: 1000,
+      })
+    }
+    getFoo() {
+      return this.get(path)
+    }
+  }
+
+  const [first, second] = await Promise.all([
+    new DataSource().getFoo(),
+    new DataSource().getFoo(),
+  ])
+
+  t.deepEqual(first.body, wanted)
+  t.deepEqual(second.body, wanted)
+
+  // the settled request was released and the failure is delivered to both callers
+  await Promise.all([
+    t.throwsAsync(new DataSource().getFoo(), { instanceOf: RequestError }),
+    t.throwsAsync(new DataSource().getFoo(), { instanceOf: RequestError }),
+  ])
+})
+
+test('Should share a GET request in flight of traced requests and keep its timings', async (t) => {
+  t.plan(5)
+
+  const path = '/'
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    setTimeout(() => {
+      res.writeHead(200)
+      res.end()
+      res.socket?.unref()
+    }, 50)
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  let spans = 0
+
+  const tracer: Tracer = {
+    startSpan() {
+      const spanId = String(++spans).padStart(16, '0')
+      return {
+        spanContext() {
+          return { traceId: '0af7651916cd43dd8448eb211c80319c', spanId, traceFlags: 1 }
+        },
+        setAttribute() {},
+        recordException() {},
+        setStatus() {},
+        end() {},
+      }
+    },
+  }
+
+  class DataSource extends HTTPDataSource {
+    constructor() {
+      super(baseURL, {
+        dedupeWindowMs: 1000,
+        collectTimings: true,
+        tracer,
+      })
+    }
+    getFoo() {
+      return this.get(path)
+    }
+  }
+
+  const [first, second] = await Promise.all([
+    new DataSource().getFoo(),
+    new DataSource().getFoo(),
+  ])
+
+  t.is(spans, 2)
+  t.false(first.timings!.fromCache)
+  // the response of the request in flight wasn't served from a cache
+  t.false(second.timings!.fromCache)
+  t.true(second.timings!.total > 0)
+})
+
+test('Should not share a GET request in flight with requests of other headers or with a signal', async (t) => {
+  t.plan(6)
+
+  const path = '/'
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(200, {
+      'content-type': 'application/json',
+    })
+    res.write(JSON.stringify({ authorization: req.headers['authorization'] }))
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  class DataSource extends HTTPDataSource {
+    constructor() {
+      super(baseURL, {
+        dedupeWindowMs: 1000,
+      })
+    }
+    getFoo(authorization: string, signal?: RequestOptions['signal']) {
+      return this.get(path, {
+        headers: {
+          authorization,
+        },
+        signal,
+      })
+    }
+  }
+
+  const [first, second, third] = await Promise.all([
+    new DataSource().getFoo('Bearer a'),
+    new DataSource().getFoo('Bearer b'),
+    new DataSource().getFoo('Bearer a', new AbortController().signal),
+  ])
+
+  t.deepEqual(first.body, { authorization: 'Bearer a' })
+  t.deepEqual(second.body, { authorization: 'Bearer b' })
+  t.deepEqual(third.body, { authorization: 'Bearer a' })
+})
+
+test('Should send a memoizable request again when a concurrent request of the same key was aborted', async (t) => {
+  t.plan(3)
+
+  const path = '/'
+
+  const wanted = { name: 'foo' }
+
+  const server = http.createServer((req, res) => {
+    setTimeout(() => {
+      res.writeHead(200, {
+        'content-type': 'application/json',
+      })
+      res.write(JSON.stringify(wanted))
+      res.end()
+      res.socket?.unref()
+    }, 50)
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const abortController = new AbortController()
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    getFoo(signal?: RequestOptions['signal']) {
+      return this.get(path, {
+        signal,
+      })
+    }
+  })()
+
+  const aborted = dataSource.getFoo(abortController.signal)
+  const joined = dataSource.getFoo()
+
+  setTimeout(() => abortController.abort(), 10)
+
+  await t.throwsAsync(aborted, { instanceOf: RequestAbortedError })
+
+  const response = await joined
+  t.deepEqual(response.body, wanted)
+  t.false(response.memoized)
+})
+
+test('Should correctly calculate and sort query parameters', async (t) => {
+  t.plan(3)
+
+  const path = '/'
+
+  const wanted = { name: 'foo' }
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    t.is(req.url, '/?a=1&b=2&z=z')
+    res.writeHead(200, {
+      'content-type': 'application/json',
+    })
+    res.write(JSON.stringify(wanted))
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    getFoo() {
+      return this.get(path, {
+        query: {
+          b: 2,
+          a: 1,
+          z: 'z',
+        },
+      })
+    }
+  })()
+
+  let response = await dataSource.getFoo()
+  t.deepEqual(response.body, wanted)
+})
+
+test('Should serialize arrays and nested objects in query parameters', async (t) => {
+  t.plan(6)
+
+  const path = '/'
+
+  const urls: string[] = []
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    urls.push(req.url!)
+    res.writeHead(200)
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL, {
+        querySerializer: 'comma',
+      })
+    }
+    getFoo(querySerializer?: QuerySerializer) {
+      return this.get(path, {
+        querySerializer,
+        query: {
+          ids: [1, 2, 3],
+          filter: { status: 'active' },
+          empty: null,
+          missing: undefined,
+        },
+      })
+    }
+  })()
+
+  await dataSource.getFoo()
+  await dataSource.getFoo('repeat')
+  await dataSource.getFoo('brackets')
+
+  t.is(urls[0], '/?filter%5Bstatus%5D=active&ids=1%2C2%2C3')
+  t.is(urls[1], '/?filter%5Bstatus%5D=active&ids=1&ids=2&ids=3')
+  t.is(urls[2], '/?filter%5Bstatus%5D=active&ids%5B%5D=1&ids%5B%5D=2&ids%5B%5D=3')
+})
+
+test('Should call onError on request error', async (t) => {
+  t.plan(11)
+
+  const path = '/'
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(500)
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+
+    onResponse<TResult = any>(request: Request, response: Response<TResult>) {
+      t.truthy(request)
+      t.truthy(response)
+      t.pass('onResponse')
+      return super.onResponse<TResult>(request, response)
+    }
+
+    onError(error: Error) {
+      t.is(error.name, 'RequestError')
+      t.is(error.message, 'Response code 500 (Internal Server Error)')
+      if (error instanceof RequestError) {
+        t.is(error.code, 500)
+        t.truthy(error.request)
+        t.truthy(error.response)
+      }
+      t.pass('onRequestError')
+    }
+
+    async getFoo() {
+      return await this.get(path)
+    }
+  })()
+
+  await t.throwsAsync(
+    dataSource.getFoo(),
+    {
+      instanceOf: Error,
+      code: 500,
+      message: 'Response code 500 (Internal Server Error)',
+    },
+    'Server error',
+  )
+})
+
+test('Should throw a RequestError with status code, body and attempts', async (t) => {
+  t.plan(8)
+
+  const path = '/'
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(404, {
+      'content-type': 'application/json',
+    })
+    res.write(JSON.stringify({ error: 'not found' }))
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    getFoo() {
+      return this.get(path, {
+        retry: {
+          maxRetries: 1,
+          delay: 1,
+          retryableStatusCodes: [404],
+        },
+      })
+    }
+  })()
+
+  const error = await t.throwsAsync(dataSource.getFoo(), {
+    instanceOf: RequestError,
+  })
+
+  if (error instanceof RequestError) {
+    t.is(error.statusCode, 404)
+    t.deepEqual(error.body, { error: 'not found' })
+    t.is(error.request.path, path)
+    t.is(error.attempt, 2)
+    t.falsy(error.cause)
+  }
+})
+
+test('Should wrap network errors in a RequestError', async (t) => {
+  t.plan(4)
+
+  const server = http.createServer()
+  server.listen()
+  const baseURL = getBaseUrlOf(server)
+  await new Promise((resolve) => server.close(resolve))
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    getFoo() {
+      return this.get('/')
+    }
+  })()
+
+  const error = await t.throwsAsync(dataSource.getFoo(), {
+    instanceOf: RequestError,
+  })
+
+  if (error instanceof RequestError) {
+    t.is(error.statusCode, 0)
+    t.falsy(error.response)
+    t.truthy(error.cause)
+  }
+})
+
+test('Should be possible to pass a request context', async (t) => {
+  t.plan(3)
+
+  const path = '/'
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(200)
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+
+    onResponse<TResult = any>(request: Request, response: Response<TResult>) {
+      t.deepEqual(request.context, { a: '1' })
+      t.pass('onResponse')
+      return super.onResponse<TResult>(request, response)
+    }
+
+    async getFoo() {
+      return await this.get(path, {
+        context: {
+          a: '1',
+        },
+      })
+    }
+  })()
+
+  await dataSource.getFoo()
+})
+
+test('Should pass the context of the request to the hooks', async (t) => {
+  t.plan(6)
+
+  const path = '/'
+
+  const context = {
+    service: 'movies',
+    requestId: '42',
+    locale: 'de',
+  }
+
+  const server = http.createServer((req, res) => {
+    t.is(req.headers['x-request-id'], '42')
+    res.writeHead(500)
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL, {
+        requestOptions: {
+          context: {
+            service: 'movies',
+          },
+        },
+      })
+    }
+    onCacheKeyCalculation(request: Request) {
+      t.is(request.context.locale, 'de')
+      return super.onCacheKeyCalculation(request) + request.context.locale
+    }
+    async onRequest(request: Request) {
+      request.headers['x-request-id'] = request.context.requestId
+    }
+    onRetry(_error: Error, request: Request) {
+      t.deepEqual(request.context, context)
+    }
+    onError(_error: Error, request: Request) {
+      t.deepEqual(request.context, context)
+    }
+    getFoo() {
+      return this.get(path, {
+        context: {
+          requestId: '42',
+          locale: 'de',
+        },
+        retry: {
+          maxRetries: 1,
+          delay: 0,
+        },
+      })
+    }
+  })()
+
+  await t.throwsAsync(dataSource.getFoo(), { instanceOf: RequestError })
+})
+
+test.cb('Should abort request when abortController signal is called', (t) => {
+  t.plan(2)
+
+  const path = '/'
+
+  const server = http
+    .createServer((req, res) => {
+      t.is(req.method, 'GET')
+      setTimeout(() => {
+        res.writeHead(200)
+        res.end()
+        res.socket?.unref()
+      }, 50)
+    })
+    .unref()
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const abortController = new AbortController()
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+
+    async getFoo() {
+      return await this.get(path, {
+        signal: abortController.signal,
+      })
+    }
+  })()
+
+  t.throwsAsync(
+    async () => {
+      try {
+        await dataSource.getFoo()
+        t.fail()
+      } catch (error) {
+        t.pass('Throw error')
+        throw error
+      }
+    },
+    {
+      instanceOf: RequestAbortedError,
+      message: 'Request aborted',
+    },
+    'Timeout',
+  ).finally(t.end)
+
+  abortController.abort()
+})
+
+test.cb('Should timeout because server does not respond fast enough', (t) => {
+  t.plan(3)
+
+  const path = '/'
+
+  const server = http
+    .createServer((req, res) => {
+      t.is(req.method, 'GET')
+      setTimeout(() => {
+        res.writeHead(200)
+        res.end()
+        res.socket?.unref()
+      }, 100)
+    })
+    .unref()
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL, {
+        clientOptions: {
+          bodyTimeout: 50,
+          headersTimeout: 50,
+        },
+      })
+    }
+
+    async getFoo() {
+      return await this.get(path)
+    }
+  })()
+
+  t.throwsAsync(
+    async () => {
+      try {
+        await dataSource.getFoo()
+        t.fail()
+      } catch (error) {
+        t.pass('Throw error')
+        throw error
+      }
+    },
+    {
+      instanceOf: Error,
+      message: 'Headers Timeout Error',
+    },
+    'Timeout',
+  ).finally(t.end)
+})
+
+test('Should be able to override the body timeout per request', async (t) => {
+  t.plan(3)
+
+  const path = '/'
+
+  const server = http
+    .createServer((req, res) => {
+      t.is(req.method, 'GET')
+      res.writeHead(200, {
+        'content-type': 'application/json',
+      })
+      res.flushHeaders()
+      setTimeout(() => {
+        res.end(JSON.stringify({ name: 'foo' }))
+        res.socket?.unref()
+      }, 100)
+    })
+    .unref()
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+
+    async getFoo() {
+      return await this.get(path, {
+        timeouts: {
+          body: 50,
+        },
+      })
+    }
+  })()
+
+  const error = await t.throwsAsync(dataSource.getFoo(), {
+    instanceOf: RequestTimeoutError,
+    message: 'Body Timeout Error',
+  })
+
+  t.is((error as RequestTimeoutError).timeout, 'body')
+})
+
+test('Should refresh the token of the auth provider once on concurrent 401 responses', async (t) => {
+  t.plan(4)
+
+  const wanted = { name: 'foo' }
+
+  const server = http.createServer((req, res) => {
+    if (req.headers['authorization'] === 'Bearer new') {
+      res.writeHead(200, {
+        'content-type': 'application/json',
+      })
+      res.write(JSON.stringify(wanted))
+    } else {
+      res.writeHead(401)
+    }
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  let tokenRefreshes = 0
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL, {
+        authProvider: {
+          async getToken() {
+            return 'old'
+          },
+          async refreshToken() {
+            tokenRefreshes++
+            await new Promise((resolve) => setTimeout(resolve, 10))
+            return 'new'
+          },
+        },
+      })
+    }
+    getFoo(path: string) {
+      return this.get(path)
+    }
+  })()
+
+  const responses = await Promise.all([dataSource.getFoo('/a'), dataSource.getFoo('/b')])
+
+  t.is(tokenRefreshes, 1)
+  t.is(responses.length, 2)
+  for (const response of responses) {
+    t.deepEqual(response.body, wanted)
+  }
+})
+
+test('Should look up the authorization and content-type headers regardless of their case', async (t) => {
+  t.plan(4)
+
+  const path = '/'
+
+  const server = http.createServer((req, res) => {
+    const names = req.rawHeaders.filter((_item, i) => i % 2 === 0).map((name) => name.toLowerCase())
+    t.is(names.filter((name) => name === 'authorization').length, 1)
+    t.is(names.filter((name) => name === 'content-type').length, 1)
+    t.is(req.headers['authorization'], 'Bearer default')
+    t.is(req.headers['content-type'], 'application/vnd.api+json')
+    res.writeHead(200)
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL, {
+        defaultHeaders: {
+          Authorization: 'Bearer default',
+        },
+        authProvider: {
+          async getToken() {
+            return 'provider'
+          },
+          async refreshToken() {
+            return 'provider'
+          },
+        },
+      })
+    }
+    postFoo() {
+      return this.post(path, {
+        headers: {
+          'Content-Type': 'application/vnd.api+json',
+        },
+        body: {
+          name: 'foo',
+        },
+      })
+    }
+  })()
+
+  await dataSource.postFoo()
+})
+
+test('Should be able to modify request in willSendRequest', async (t) => {
+  t.plan(3)
+
+  const path = '/'
+
+  const wanted = { name: 'foo' }
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    t.deepEqual(req.headers['x-foo'], 'bar')
+    res.writeHead(200, {
+      'content-type': 'application/json',
+    })
+    res.write(JSON.stringify(wanted))
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    async onRequest(request: Request) {
+      request.headers = {
+        'X-Foo': 'bar',
+      }
+    }
+    getFoo() {
+      return this.get(path)
+    }
+  })()
+
+  const response = await dataSource.getFoo()
+
+  t.deepEqual(response.body, wanted)
+})
+
+test('Should be able to define base headers for every request', async (t) => {
+  t.plan(4)
+
+  const path = '/'
+
+  const wanted = { name: 'foo' }
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    t.deepEqual(req.headers['x-foo'], 'bar')
+    res.writeHead(200, {
+      'content-type': 'application/json',
+    })
+    res.write(JSON.stringify(wanted))
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL, {
+        requestOptions: {
+          headers: {
+            'X-Foo': 'bar',
+          },
+        },
+      })
+    }
+    async onRequest(request: Request) {
+      t.deepEqual(request.headers, {
+        'X-Foo': 'bar',
+      })
+    }
+    getFoo() {
+      return this.get(path)
+    }
+  })()
+
+  const response = await dataSource.getFoo()
+
+  t.deepEqual(response.body, wanted)
+})
+
+test('Should merge default headers case-insensitively with the headers of the request', async (t) => {
+  t.plan(5)
+
+  const path = '/'
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    t.is(req.headers['x-api-key'], 'key')
+    t.is(req.headers['authorization'], 'Bearer request')
+    res.writeHead(200)
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL, {
+        defaultHeaders: (request) => ({
+          'x-api-key': 'key',
+          Authorization: `Bearer ${request.path}`,
+        }),
+      })
+    }
+    async onRequest(request: Request) {
+      t.deepEqual(request.headers, {
+        'x-api-key': 'key',
+        authorization: 'Bearer request',
+      })
+    }
+    getFoo() {
+      return this.get(path, {
+        headers: {
+          authorization: 'Bearer request',
+        },
+      })
+    }
+  })()
+
+  const response = await dataSource.getFoo()
+
+  t.is(response.statusCode, 200)
+})
+
+test('Initialize data source with cache and context', async (t) => {
+  t.plan(3)
+
+  const path = '/'
+
+  const wanted = { name: 'foo' }
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(200, {
+      'content-type': 'application/json',
+    })
+    res.write(JSON.stringify(wanted))
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    getFoo() {
+      t.deepEqual(this.context, {
+        a: 1,
+      })
+      return this.get(path)
+    }
+  })()
+
+  const cacheMap = new Map<string, string>()
+
+  dataSource.initialize({
+    context: {
+      a: 1,
+    },
+    cache: {
+      async delete(key: string) {
+        return cacheMap.delete(key)
+      },
+      async get(key: string) {
+        return cacheMap.get(key)
+      },
+      async set(key: string, value: string) {
+        cacheMap.set(key, value)
+      },
+    },
+  })
+
+  const response = await dataSource.getFoo()
+
+  t.deepEqual(response.body, wanted)
+})
+
+test('Should use the custom JSON functions for the response and the cache', async (t) => {
+  t.plan(6)
+
+  const path = '/'
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(200, {
+      'content-type': 'application/json',
+    })
+    res.write(JSON.stringify({ createdAt: '2022-01-01T00:00:00.000Z' }))
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL, {
+        jsonParse: (text) =>
+          JSON.parse(text, (key, value) => (key === 'createdAt' ? new Date(value) : value)),
+        jsonStringify: (value) => {
+          t.pass()
+          return JSON.stringify(value)
+        },
+      })
+    }
+    getFoo() {
+      return this.get<{ createdAt: Date }>(path, {
+        memoize: false,
+        requestCache: {
+          maxTtl: 10,
+          maxTtlIfError: 20,
+        },
+      })
+    }
+  })()
+
+  const cacheMap = new Map<string, string>()
+
+  dataSource.initialize({
+    context: {},
+    cache: {
+      async delete(key: string) {
+        return cacheMap.delete(key)
+      },
+      async get(key: string) {
+        return cacheMap.get(key)
+      },
+      async set(key: string, value: string) {
+        cacheMap.set(key, value)
+      },
+    },
+  })
+
+  let response = await dataSource.getFoo()
+  t.false(response.isFromCache)
+  t.deepEqual(response.body.createdAt, new Date('2022-01-01T00:00:00.000Z'))
+
+  response = await dataSource.getFoo()
+  t.true(response.isFromCache)
+  t.deepEqual(response.body.createdAt, new Date('2022-01-01T00:00:00.000Z'))
+})
+
+test('Should calculate the cache key of a body with the custom jsonStringify', async (t) => {
+  t.plan(3)
+
+  const path = '/'
+
+  const server = http.createServer(async (req, res) => {
+    const chunks: Buffer[] = []
+    for await (const chunk of req) {
+      chunks.push(chunk)
+    }
+    t.is(Buffer.concat(chunks).toString(), '{"id":"1"}')
+    res.writeHead(200)
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL, {
+        jsonStringify: (value) =>
+          JSON.stringify(value, (_key, item) =>
+            typeof item === 'bigint' ? item.toString() : item,
+          ),
+      })
+    }
+    postFoo() {
+      return this.post(path, {
+        memoize: true,
+        body: {
+          id: BigInt(1),
+        },
+      })
+    }
+  })()
+
+  let response = await dataSource.postFoo()
+  t.false(response.memoized)
+
+  response = await dataSource.postFoo()
+  t.true(response.memoized)
+})
+
+test('Should resolve the ttl of the request cache by a maxTtl function', async (t) => {
+  t.plan(12)
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    if (req.url === '/moved') {
+      res.writeHead(302, { location: '/ok' })
+    } else {
+      res.writeHead(req.url === '/empty' ? 404 : req.url === '/created' ? 201 : 200)
+    }
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    getFoo(path: string) {
+      return this.get(path, {
+        // a 404 is an empty result which is cached for a short time
+        validateStatus: (statusCode) => statusCode < 400 || statusCode === 404,
+        requestCache: {
+          maxTtl: (response) =>
+            response.statusCode === 200
+              ? 300
+              : response.statusCode === 404
+              ? 10
+              : response.statusCode === 302
+              ? 60
+              : false,
+          maxTtlIfError: 0,
+          serveStaleOnError: false,
+        },
+      })
+    }
+  })()
+
+  const ttls = new Map<string, number | undefined>()
+
+  dataSource.initialize({
+    context: {},
+    cache: {
+      async delete(key: string) {
+        return ttls.delete(key)
+      },
+      async get() {
+        return undefined
+      },
+      async set(key: string, _value: string, options?: KeyValueCacheSetOptions) {
+        ttls.set(key, options?.ttl)
+      },
+    },
+  })
+
+  await dataSource.getFoo('/ok')
+  await dataSource.getFoo('/empty')
+  await dataSource.getFoo('/moved')
+  await dataSource.getFoo('/created')
+
+  t.is(ttls.get(baseURL + '/ok'), 300)
+  t.is(ttls.get(baseURL + '/empty'), 10)
+  t.false(ttls.has(baseURL + '/moved'))
+  t.false(ttls.has(baseURL + '/created'))
+
+  let response = await dataSource.getFoo('/ok')
+  t.true(response.memoized)
+  response = await dataSource.getFoo('/created')
+  t.false(response.memoized)
+  t.is(response.statusCode, 201)
+})
+
+test('Should cache a GET response and respond with the result on subsequent calls', async (t) => {
+  t.plan(15)
+
+  const path = '/'
+
+  const wanted = { name: 'foo' }
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(200, {
+      'content-type': 'application/json',
+    })
+    res.write(JSON.stringify(wanted))
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  let dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    getFoo() {
+      return this.get(path, {
+        requestCache: {
+          maxTtl: 10,
+          maxTtlIfError: 20,
+        },
+      })
+    }
+  })()
+
+  const cacheMap = new Map<string, string>()
+  const datasSourceConfig = {
+    context: {
+      a: 1,
+    },
+    cache: {
+      async delete(key: string) {
+        return cacheMap.delete(key)
+      },
+      async get(key: string) {
+        return cacheMap.get(key)
+      },
+      async set(key: string, value: string) {
+        cacheMap.set(key, value)
+      },
+    },
+  }
+
+  dataSource.initialize(datasSourceConfig)
+
+  let response = await dataSource.getFoo()
+  t.false(response.isFromCache)
+  t.false(response.memoized)
+  t.is(response.maxTtl, 10)
+  t.deepEqual(response.body, wanted)
+
+  response = await dataSource.getFoo()
+  t.false(response.isFromCache)
+  t.true(response.memoized)
+  t.is(response.maxTtl, 10)
+  t.deepEqual(response.body, wanted)
+
+  dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    getFoo() {
+      return this.get(path, {
+        requestCache: {
+          maxTtl: 10,
+          maxTtlIfError: 20,
+        },
+      })
+    }
+  })()
+
+  dataSource.initialize(datasSourceConfig)
+
+  response = await dataSource.getFoo()
+  t.true(response.isFromCache)
+  t.false(response.memoized)
+  t.is(response.maxTtl, 10)
+  t.deepEqual(response.body, wanted)
+
+  const cached = JSON.parse(cacheMap.get(baseURL + path)!)
+
+  t.is(cacheMap.size, 2)
+  t.like(cached, {
+    statusCode: 200,
+    trailers: {},
+    opaque: null,
+    headers: {
+      connection: 'keep-alive',
+      'keep-alive': 'timeout=5',
+      'transfer-encoding': 'chunked',
+    },
+    body: wanted,
+  })
+})
+
+test('Should call onCacheHit and onCacheMiss for memoized and cached responses', async (t) => {
+  t.plan(3)
+
+  const path = '/'
+
+  const wanted = { name: 'foo' }
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(200, {
+      'content-type': 'application/json',
+    })
+    res.write(JSON.stringify(wanted))
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const events: string[] = []
+
+  class DataSource extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    onCacheHit(_request: Request, cacheKey: string, source: CacheSource) {
+      events.push(`hit:${source}:${cacheKey}`)
+    }
+    onCacheMiss(_request: Request, cacheKey: string, source: CacheSource) {
+      events.push(`miss:${source}:${cacheKey}`)
+    }
+    getFoo() {
+      return this.get(path, {
+        requestCache: {
+          maxTtl: 10,
+          maxTtlIfError: 20,
+        },
+      })
+    }
+  }
+
+  const cacheMap = new Map<string, string>()
+  const datasSourceConfig = {
+    context: {
+      a: 1,
+    },
+    cache: {
+      async delete(key: string) {
+        return cacheMap.delete(key)
+      },
+      async get(key: string) {
+        return cacheMap.get(key)
+      },
+      async set(key: string, value: string) {
+        cacheMap.set(key, value)
+      },
+    },
+  }
+
+  let dataSource = new DataSource()
+  dataSource.initialize(datasSourceConfig)
+
+  await dataSource.getFoo()
+  await dataSource.getFoo()
+
+  dataSource = new DataSource()
+  dataSource.initialize(datasSourceConfig)
+
+  await dataSource.getFoo()
+
+  const cacheKey = baseURL + path
+
+  t.deepEqual(events, [
+    `miss:memoize:${cacheKey}`,
+    `miss:requestCache:${cacheKey}`,
+    `hit:memoize:${cacheKey}`,
+    `miss:memoize:${cacheKey}`,
+    `hit:requestCache:${cacheKey}`,
+  ])
+  t.is(cacheMap.size, 2)
+})
+
+test('Should fill the request cache with prefetch', async (t) => {
+  t.plan(8)
+
+  const path = '/'
+
+  const wanted = { name: 'foo' }
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(200, {
+      'content-type': 'application/json',
+    })
+    res.write(JSON.stringify(wanted))
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const requestCache = {
+    maxTtl: 10,
+    maxTtlIfError: 20,
+  }
+
+  class DataSource extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    getFoo() {
+      return this.get(path, {
+        requestCache,
+      })
+    }
+  }
+
+  const cacheMap = new Map<string, string>()
+  const datasSourceConfig = {
+    context: {},
+    cache: {
+      async delete(key: string) {
+        return cacheMap.delete(key)
+      },
+      async get(key: string) {
+        return cacheMap.get(key)
+      },
+      async set(key: string, value: string) {
+        cacheMap.set(key, value)
+      },
+    },
+  }
+
+  let dataSource = new DataSource()
+  dataSource.initialize(datasSourceConfig)
+
+  t.true(await dataSource.prefetch(path, { requestCache }))
+  t.false(await dataSource.prefetch('/uncached'))
+
+  dataSource = new DataSource()
+  dataSource.initialize(datasSourceConfig)
+
+  const response = await dataSource.getFoo()
+  t.true(response.isFromCache)
+  t.deepEqual(response.body, wanted)
+
+  // the cache is unreachable
+  dataSource = new DataSource()
+  dataSource.initialize({
+    context: {},
+    cache: {
+      async delete() {
+        return false
+      },
+      async get() {
+        return undefined
+      },
+      async set() {
+        throw new Error('connection refused')
+      },
+    },
+  })
+
+  t.false(await dataSource.prefetch(path, { requestCache }))
+})
+
+test('Should respond with a stale result and revalidate it in the background', async (t) => {
+  t.plan(12)
+
+  const path = '/'
+
+  let reqCount = 0
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    reqCount++
+    res.writeHead(200, {
+      'content-type': 'application/json',
+    })
+    res.write(JSON.stringify({ count: reqCount }))
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  class DataSource extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    getFoo() {
+      return this.get(path, {
+        requestCache: {
+          maxTtl: 10,
+          maxTtlIfError: 20,
+          swr: 30,
+        },
+      })
+    }
+  }
+
+  const cacheMap = new Map<string, string>()
+  const datasSourceConfig = {
+    context: {
+      a: 1,
+    },
+    cache: {
+      async delete(key: string) {
+        return cacheMap.delete(key)
+      },
+      async get(key: string) {
+        return cacheMap.get(key)
+      },
+      async set(key: string, value: string) {
+        cacheMap.set(key, value)
+      },
+    },
+  }
+
+  let dataSource = new DataSource()
+  dataSource.initialize(datasSourceConfig)
+
+  const response = await dataSource.getFoo()
+  t.deepEqual(response.body, { count: 1 })
+  t.is(cacheMap.size, 3)
+
+  const cacheKey = baseURL + path
+  cacheMap.delete(cacheKey) // ttl is up
+
+  dataSource = new DataSource()
+  dataSource.initialize(datasSourceConfig)
+
+  const responses = await Promise.all([dataSource.getFoo(), dataSource.getFoo()])
+  for (const staleResponse of responses) {
+    t.deepEqual(staleResponse.body, { count: 1 })
+    t.true(staleResponse.isFromCache)
+    t.true(staleResponse.isStale)
+  }
+
+  while (!cacheMap.has(cacheKey)) {
+    await new Promise((resolve) => setTimeout(resolve, 10))
+  }
+
+  t.is(reqCount, 2)
+  t.deepEqual(JSON.parse(cacheMap.get(cacheKey)!).body, { count: 2 })
+})
+
+test('Should prepend the key prefix to the cache key', async (t) => {
+  t.plan(5)
+
+  const path = '/'
+
+  const wanted = { name: 'foo' }
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(200, {
+      'content-type': 'application/json',
+    })
+    res.write(JSON.stringify(wanted))
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL, {
+        cacheKeyPrefix: 'tenant-a:',
+      })
+    }
+    onCacheKeyCalculation(request: Request) {
+      const cacheKey = super.onCacheKeyCalculation(request)
+      t.is(cacheKey, `tenant-${request.path === '/?b=true' ? 'b' : 'a'}:${baseURL}${request.path}`)
+      return cacheKey
+    }
+    getFoo(tenantB: boolean) {
+      return this.get(path, {
+        query: {
+          b: tenantB,
+        },
+        requestCache: {
+          maxTtl: 10,
+          maxTtlIfError: 20,
+          keyPrefix: tenantB ? 'tenant-b:' : undefined,
+        },
+      })
+    }
+  })()
+
+  const cacheMap = new Map<string, string>()
+
+  dataSource.initialize({
+    context: {
+      a: 1,
+    },
+    cache: {
+      async delete(key: string) {
+        return cacheMap.delete(key)
+      },
+      async get(key: string) {
+        return cacheMap.get(key)
+      },
+      async set(key: string, value: string) {
+        cacheMap.set(key, value)
+      },
+    },
+  })
+
+  await dataSource.getFoo(false)
+  await dataSource.getFoo(true)
+
+  t.deepEqual(
+    [...cacheMap.keys()].sort(),
+    [
+      `tenant-a:${baseURL}/?b=false`,
+      `tenant-a:staleIfError:${baseURL}/?b=false`,
+      `tenant-b:${baseURL}/?b=true`,
+      `tenant-b:staleIfError:${baseURL}/?b=true`,
+    ],
+  )
+})
+
+test('Should respond with stale-if-error cache on origin error', async (t) => {
+  t.plan(14)
+
+  const path = '/'
+
+  const wanted = { name: 'foo' }
+
+  let reqCount = 0
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+
+    if (reqCount === 0)
+      res.writeHead(200, {
+        'content-type': 'application/json',
+      })
+    else
+      res.writeHead(500, {
+        'content-type': 'application/json',
+      })
+
+    res.write(JSON.stringify(wanted))
+    res.end()
+    res.socket?.unref()
+    reqCount++
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  let dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    getFoo() {
+      return this.get(path, {
+        requestCache: {
+          maxTtl: 10,
+          maxTtlIfError: 20,
+        },
+      })
+    }
+  })()
+
+  const cacheMap = new Map<string, string>()
+  const datasSourceConfig = {
+    context: {
+      a: 1,
+    },
+    cache: {
+      async delete(key: string) {
+        return cacheMap.delete(key)
+      },
+      async get(key: string) {
+        return cacheMap.get(key)
+      },
+      async set(key: string, value: string) {
+        cacheMap.set(key, value)
+      },
+    },
+  }
+
+  dataSource.initialize(datasSourceConfig)
+
+  let response = await dataSource.getFoo()
+  t.false(response.isFromCache)
+  t.false(response.memoized)
+  t.is(response.maxTtl, 10)
+
+  t.deepEqual(response.body, wanted)
+
+  t.is(cacheMap.size, 2)
+
+  cacheMap.delete(baseURL + path) // ttl is up
+
+  const cacheHits: string[] = []
+
+  dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    onCacheHit(_request: Request, cacheKey: string, source: CacheSource) {
+      cacheHits.push(`${source}:${cacheKey}`)
+    }
+    getFoo() {
+      return this.get(path, {
+        requestCache: {
+          maxTtl: 10,
+          maxTtlIfError: 20,
+        },
+      })
+    }
+  })()
+
+  dataSource.initialize(datasSourceConfig)
+
+  response = await dataSource.getFoo()
+  t.true(response.isFromCache)
+  t.true(response.isStale)
+  t.false(response.memoized)
+  t.is(response.maxTtl, 10)
+
+  t.deepEqual(response.body, wanted)
+  t.deepEqual(cacheHits, [`requestCache:${baseURL}${path}`])
+
+  t.is(cacheMap.size, 1)
+})
+
+test('Should not respond with stale cache on origin error when serveStaleOnError is disabled', async (t) => {
+  t.plan(4)
+
+  const path = '/'
+
+  const wanted = { name: 'foo' }
+
+  let reqCount = 0
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(reqCount === 0 ? 200 : 500, {
+      'content-type': 'application/json',
+    })
+    res.write(JSON.stringify(wanted))
+    res.end()
+    res.socket?.unref()
+    reqCount++
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  class DataSource extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    getFoo() {
+      return this.get(path, {
+        requestCache: {
+          maxTtl: 10,
+          maxTtlIfError: 20,
+          serveStaleOnError: false,
+        },
+      })
+    }
+  }
+
+  const cacheMap = new Map<string, string>()
+  const datasSourceConfig = {
+    context: {
+      a: 1,
+    },
+    cache: {
+      async delete(key: string) {
+        return cacheMap.delete(key)
+      },
+      async get(key: string) {
+        return cacheMap.get(key)
+      },
+      async set(key: string, value: string) {
+        cacheMap.set(key, value)
+      },
+    },
+  }
+
+  let dataSource = new DataSource()
+  dataSource.initialize(datasSourceConfig)
+
+  await dataSource.getFoo()
+  t.is(cacheMap.size, 1)
+
+  cacheMap.delete(baseURL + path) // ttl is up
+
+  dataSource = new DataSource()
+  dataSource.initialize(datasSourceConfig)
+
+  await t.throwsAsync(dataSource.getFoo(), {
+    code: 500,
+    message: 'Response code 500 (Internal Server Error)',
+  })
+})
+
+test('Should cache GET responses according to the Cache-Control header', async (t) => {
+  t.plan(8)
+
+  const path = '/'
+
+  const wanted = { name: 'foo' }
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(200, {
+      'content-type': 'application/json',
+      'cache-control':
+        req.url === '/?private=true' ? 'private, max-age=60' : 'public, max-age=60, s-maxage=120',
+    })
+    res.write(JSON.stringify(wanted))
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL, {
+        respectCacheControl: true,
+      })
+    }
+    getFoo(isPrivate: boolean) {
+      return this.get(path, {
+        query: {
+          private: isPrivate,
+        },
+      })
+    }
+  })()
+
+  const cacheMap = new Map<string, string>()
+  const ttls = new Map<string, number | null | undefined>()
+
+  dataSource.initialize({
+    context: {
+      a: 1,
+    },
+    cache: {
+      async delete(key: string) {
+        return cacheMap.delete(key)
+      },
+      async get(key: string) {
+        return cacheMap.get(key)
+      },
+      async set(key: string, value: string, options?: KeyValueCacheSetOptions) {
+        cacheMap.set(key, value)
+        ttls.set(key, options?.ttl)
+      },
+    },
+  })
+
+  let response = await dataSource.getFoo(false)
+  t.deepEqual(response.body, wanted)
+  t.is(response.maxTtl, 120)
+  t.is(ttls.get(baseURL + path + '?private=false'), 120)
+
+  response = await dataSource.getFoo(true)
+  t.deepEqual(response.body, wanted)
+  t.falsy(response.maxTtl)
+  t.false(cacheMap.has(baseURL + path + '?private=true'))
+})
+
+test('Should revalidate an expired cache item with its ETag', async (t) => {
+  t.plan(10)
+
+  const path = '/'
+
+  const wanted = { name: 'foo' }
+
+  let reqCount = 0
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    reqCount++
+    if (req.headers['if-none-match'] === '"v1"') {
+      res.writeHead(304, {
+        etag: '"v1"',
+      })
+      res.end()
+    } else {
+      res.writeHead(200, {
+        'content-type': 'application/json',
+        etag: '"v1"',
+      })
+      res.write(JSON.stringify(wanted))
+      res.end()
+    }
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  class DataSource extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    getFoo() {
+      return this.get(path, {
+        requestCache: {
+          maxTtl: 10,
+          maxTtlIfError: 20,
+          revalidate: true,
+        },
+      })
+    }
+  }
+
+  const cacheMap = new Map<string, string>()
+  const datasSourceConfig = {
+    context: {
+      a: 1,
+    },
+    cache: {
+      async delete(key: string) {
+        return cacheMap.delete(key)
+      },
+      async get(key: string) {
+        return cacheMap.get(key)
+      },
+      async set(key: string, value: string) {
+        cacheMap.set(key, value)
+      },
+    },
+  }
+
+  let dataSource = new DataSource()
+  dataSource.initialize(datasSourceConfig)
+
+  let response = await dataSource.getFoo()
+  t.deepEqual(response.body, wanted)
+  t.is(cacheMap.size, 3)
+
+  const cacheKey = baseURL + path
+  cacheMap.delete(cacheKey) // ttl is up
+
+  dataSource = new DataSource()
+  dataSource.initialize(datasSourceConfig)
+
+  response = await dataSource.getFoo()
+  t.is(response.statusCode, 200)
+  t.deepEqual(response.body, wanted)
+  t.true(response.isFromCache)
+  t.false(response.memoized)
+  t.true(cacheMap.has(cacheKey))
+  t.is(reqCount, 2)
+})
+
+test('Should not cache POST requests by default', async (t) => {
+  t.plan(6)
+
+  const path = '/'
+
+  const wanted = { name: 'foo' }
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'POST')
+    res.writeHead(200, {
+      'content-type': 'application/json',
+    })
+    res.write(JSON.stringify(wanted))
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    postFoo() {
+      return this.post(path, {
+        requestCache: {
+          maxTtl: 10,
+          maxTtlIfError: 20,
+        },
+      })
+    }
+  })()
+
+  const cacheMap = new Map<string, string>()
+
+  dataSource.initialize({
+    context: {
+      a: 1,
+    },
+    cache: {
+      async delete(key: string) {
+        return cacheMap.delete(key)
+      },
+      async get(key: string) {
+        return cacheMap.get(key)
+      },
+      async set(key: string, value: string, options: KeyValueCacheSetOptions) {
+        t.deepEqual(options, { ttl: 10 })
+        cacheMap.set(key, value)
+      },
+    },
+  })
+
+  const response = await dataSource.postFoo()
+  t.false(response.isFromCache)
+  t.false(response.memoized)
+  t.falsy(response.maxTtl)
+
+  t.deepEqual(response.body, wanted)
+
+  t.is(cacheMap.size, 0)
+})
+
+test('Should only cache GET successful responses with the correct status code', async (t) => {
+  t.plan(30)
+
+  const path = '/'
+
+  const wanted = { name: 'foo' }
+  const server = http.createServer((req, res) => {
+    const queryObject = querystring.parse(req.url?.replace('/?', '')!)
+    t.is(req.method, 'GET')
+    res.writeHead(queryObject['statusCode'] as unknown as number, {
+      'content-type': 'application/json',
+    })
+    res.write(JSON.stringify(wanted))
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    getFoo(statusCode: number) {
+      return this.get(path, {
+        query: {
+          statusCode,
+        },
+        requestCache: {
+          maxTtl: 10,
+          maxTtlIfError: 20,
+        },
+      })
+    }
+  })()
+
+  const cacheMap = new Map<string, string>()
+
+  dataSource.initialize({
+    context: {
+      a: 1,
+    },
+    cache: {
+      async delete(key: string) {
+        return cacheMap.delete(key)
+      },
+      async get(key: string) {
+        return cacheMap.get(key)
+      },
+      async set(key: string, value: string) {
+        cacheMap.set(key, value)
+      },
+    },
+  })
+
+  let response = await dataSource.getFoo(200)
+  t.false(response.isFromCache)
+  t.false(response.memoized)
+  t.is(response.maxTtl, 10)
+  t.deepEqual(response.body, wanted)
+  t.is(cacheMap.size, 2)
+
+  cacheMap.clear()
+
+  response = await dataSource.getFoo(203)
+  t.false(response.isFromCache)
+  t.false(response.memoized)
+  t.is(response.maxTtl, 10)
+  t.deepEqual(response.body, wanted)
+  t.is(cacheMap.size, 2)
+
+  cacheMap.clear()
+
+  // 204 = no content
+  response = await dataSource.getFoo(204)
+  t.false(response.isFromCache)
+  t.false(response.memoized)
+  t.falsy(response.maxTtl)
+  t.falsy(response.body)
+  t.is(cacheMap.size, 0)
+
+  cacheMap.clear()
+
+  response = await dataSource.getFoo(300)
+  t.false(response.isFromCache)
+  t.false(response.memoized)
+  t.falsy(response.maxTtl)
+  t.deepEqual(response.body, wanted)
+  t.is(cacheMap.size, 0)
+
+  cacheMap.clear()
+
+  response = await dataSource.getFoo(301)
+  t.false(response.isFromCache)
+  t.false(response.memoized)
+  t.falsy(response.maxTtl)
+  t.deepEqual(response.body, wanted)
+  t.is(cacheMap.size, 0)
+})
+
+test('Should cache POST successful responses if isRequestCacheable allows to do so', async (t) => {
+  t.plan(7)
+
+  const path = '/custom/cacheable/post/route'
+
+  const wanted = { name: 'foo' }
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'POST')
+    res.writeHead(200, {
+      'content-type': 'application/json',
+    })
+    res.write(JSON.stringify(wanted))
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = `http://localhost:${(server.address() as AddressInfo)?.port}`
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    protected isRequestCacheable(request: Request): boolean {
+      return request.method === 'GET' || (request.method === 'POST' && request.path === path)
+    }
+    postFoo() {
+      return this.post(path, {
+        body: wanted,
+        requestCache: {
+          maxTtl: 10,
+          maxTtlIfError: 20,
+        },
+      })
+    }
+  })()
+
+  const cacheMap = new Map<string, string>()
+
+  dataSource.initialize({
+    context: {
+      a: 1,
+    },
+    cache: {
+      async delete(key: string) {
+        return cacheMap.delete(key)
+      },
+      async get(key: string) {
+        return cacheMap.get(key)
+      },
+      async set(key: string, value: string) {
+        cacheMap.set(key, value)
+      },
+    },
+  })
+
+  let response = await dataSource.postFoo()
+  t.deepEqual(response.body, wanted)
+  t.false(response.memoized)
+  t.false(response.isFromCache)
+
+  response = await dataSource.postFoo()
+  t.deepEqual(response.body, wanted)
+  t.false(response.memoized)
+  t.true(response.isFromCache)
+})
+
+test.serial('Global maxAge should be used when no maxAge was set or similar.', async (t) => {
+  const path = '/'
+
+  const clock = FakeTimers.install()
+  t.teardown(clock.uninstall.bind(clock))
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(200)
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  let testResponse: Pick<Response<any>, 'memoized'> = {
+    memoized: false,
+  }
+  const maxAge = 10000
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL, {
+        lru: {
+          maxAge: maxAge,
+        },
+      })
+    }
+    getFoo() {
+      return this.get(path)
+    }
+    onResponse(_: Request, response: Response<any>) {
+      testResponse = response
+      return response
+    }
+  })()
+
+  await dataSource.getFoo()
+  t.is(testResponse.memoized, false)
+  await dataSource.getFoo()
+  t.is(testResponse.memoized, true)
+  clock.tick(maxAge)
+  await dataSource.getFoo()
+  t.is(testResponse.memoized, false)
+})
+
+test('Should not memoize responses when memoizeGetRequests is disabled', async (t) => {
+  t.plan(4)
+
+  const path = '/'
+
+  const wanted = { name: 'foo' }
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(200, {
+      'content-type': 'application/json',
+    })
+    res.write(JSON.stringify(wanted))
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL, {
+        memoizeGetRequests: false,
+      })
+    }
+    getFoo() {
+      return this.get(path)
+    }
+  })()
+
+  let response = await dataSource.getFoo()
+  t.false(response.memoized)
+  response = await dataSource.getFoo()
+  t.false(response.memoized)
+})
+
+test('Response is not cached due to origin error', async (t) => {
+  const path = '/'
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(500)
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    getFoo() {
+      return this.get(path, {
+        requestCache: {
+          maxTtl: 10,
+          maxTtlIfError: 20,
+        },
+      })
+    }
+  })()
+
+  const cacheMap = new Map<string, string>()
+
+  dataSource.initialize({
+    context: {
+      a: 1,
+    },
+    cache: {
+      async delete(key: string) {
+        return cacheMap.delete(key)
+      },
+      async get(key: string) {
+        return cacheMap.get(key)
+      },
+      async set(key: string, value: string) {
+        console.log(key)
+
         cacheMap.set(key, value)
       },
     },
+  })
+
+  await t.throwsAsync(
+    dataSource.getFoo(),
+    {
+      message: 'Response code 500 (Internal Server Error)',
+      code: 500,
+    },
+    'message',
+  )
+
+  t.is(cacheMap.size, 0)
+})
+
+test('Should log structured events of the request with the logger', async (t) => {
+  t.plan(3)
+
+  const path = '/'
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(500)
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const events: string[] = []
+  const log = (level: string) => (message: any) => events.push(`${level}:${message.event}`)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL, {
+        logger: {
+          debug: log('debug'),
+          info: log('info'),
+          warn: log('warn'),
+          error: log('error'),
+        },
+      })
+    }
+    getFoo() {
+      return this.get(path, {
+        retry: {
+          maxRetries: 1,
+          delay: 0,
+        },
+      })
+    }
+  })()
+
+  await dataSource.getFoo().catch(() => {
+    t.deepEqual(events, [
+      'debug:cache:miss',
+      'debug:request:start',
+      'warn:request:retry',
+      'error:request:error',
+    ])
+  })
+})
+
+test('Should log the failures of the cache with the logger', async (t) => {
+  t.plan(3)
+
+  const path = '/'
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(200)
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const events: any[] = []
+  const log = (level: string) => (message: any) => events.push({ level, ...message })
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL, {
+        logger: {
+          debug: log('debug'),
+          info: log('info'),
+          warn: log('warn'),
+          error: log('error'),
+        },
+      })
+    }
+    getFoo() {
+      return this.get(path, {
+        requestCache: {
+          maxTtl: 10,
+          maxTtlIfError: 20,
+          serveStaleOnError: false,
+        },
+      })
+    }
+  })()
+
+  dataSource.initialize({
+    context: {},
+    cache: {
+      async delete() {
+        return true
+      },
+      async get() {
+        throw new Error('get failed')
+      },
+      async set() {
+        throw new Error('set failed')
+      },
+    },
+  })
+
+  await dataSource.getFoo()
+  // the response is stored in the background
+  await new Promise((resolve) => setTimeout(resolve, 0))
+
+  const getError = events.find((event) => event.event === 'cache:getError')
+  t.like(getError, { level: 'error', method: 'GET', cacheKey: baseURL + path, error: 'get failed' })
+  const setError = events.find((event) => event.event === 'cache:setError')
+  t.like(setError, { level: 'error', method: 'GET', cacheKey: baseURL + path, error: 'set failed' })
+})
+
+test('Should create a span for every request and propagate the traceparent header', async (t) => {
+  t.plan(7)
+
+  const path = '/'
+
+  const server = http.createServer((req, res) => {
+    t.is(req.headers['traceparent'], '00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01')
+    res.writeHead(500)
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const attributes = new Map<string, string | number | boolean>()
+  let spanName = ''
+  let exception: Error | undefined
+  let statusCode: number | undefined
+  let ended = false
+
+  const tracer: Tracer = {
+    startSpan(name, options) {
+      spanName = name
+      const spanAttributes = options?.attributes ?? {}
+      for (const key in spanAttributes) {
+        attributes.set(key, spanAttributes[key]!)
+      }
+      return {
+        spanContext() {
+          return {
+            traceId: '0af7651916cd43dd8448eb211c80319c',
+            spanId: 'b7ad6b7169203331',
+            traceFlags: 1,
+          }
+        },
+        setAttribute(key, value) {
+          attributes.set(key, value)
+        },
+        recordException(error) {
+          exception = error
+        },
+        setStatus(status) {
+          statusCode = status.code
+        },
+        end() {
+          ended = true
+        },
+      }
+    },
+  }
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL, {
+        tracer,
+      })
+    }
+    getFoo() {
+      return this.get(path)
+    }
+  })()
+
+  await t.throwsAsync(dataSource.getFoo(), {
+    message: 'Response code 500 (Internal Server Error)',
+  })
+
+  t.is(spanName, 'GET /')
+  t.deepEqual(Object.fromEntries(attributes), {
+    'http.method': 'GET',
+    'http.status_code': 500,
+    'http.url': baseURL + path,
+  })
+  t.is(exception?.message, 'Response code 500 (Internal Server Error)')
+  t.is(statusCode, 2)
+  t.true(ended)
+})
+
+test('Should be able to pass custom Undici Pool', async (t) => {
+  t.plan(2)
+
+  const path = '/'
+
+  const wanted = { name: 'foo' }
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(200, {
+      'content-type': 'application/json',
+    })
+    res.write(JSON.stringify(wanted))
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+  const pool = new Pool(baseURL)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL, {
+        pool,
+      })
+    }
+    getFoo() {
+      return this.get(path)
+    }
+  })()
+
+  const response = await dataSource.getFoo()
+
+  t.deepEqual(response.body, wanted)
+})
+
+test('Should be able to pass a custom Undici dispatcher', async (t) => {
+  t.plan(2)
+
+  const path = '/'
+
+  const wanted = { name: 'foo' }
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(200, {
+      'content-type': 'application/json',
+    })
+    res.write(JSON.stringify(wanted))
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+  const dispatcher = new Agent({
+    keepAliveTimeout: 10,
+    keepAliveMaxTimeout: 10,
+  })
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL, {
+        dispatcher,
+      })
+    }
+    getFoo() {
+      return this.get(path)
+    }
+  })()
+
+  const response = await dataSource.getFoo()
+
+  t.deepEqual(response.body, wanted)
+})
+
+test('Should send requests to the base url resolved by resolveBaseURL', async (t) => {
+  t.plan(8)
+
+  const path = '/'
+
+  const createServer = (region: string) => {
+    const server = http.createServer((req, res) => {
+      t.is(req.method, 'GET')
+      res.writeHead(200, {
+        'content-type': 'application/json',
+      })
+      res.write(JSON.stringify({ region }))
+      res.end()
+      res.socket?.unref()
+    })
+    t.teardown(server.close.bind(server))
+    server.listen()
+    return server
   }
 
-  dataSource.initialize(datasSourceConfig)
+  const euBaseURL = getBaseUrlOf(createServer('eu'))
+  const usBaseURL = getBaseUrlOf(createServer('us'))
+
+  const pools = new Map<string, Pool>()
+
+  const dataSource = new (class extends HTTPDataSource {
+    region = 'eu'
+    constructor() {
+      super(euBaseURL, {
+        pools,
+      })
+    }
+    resolveBaseURL() {
+      return this.region === 'us' ? usBaseURL : euBaseURL
+    }
+    getFoo() {
+      return this.get(path)
+    }
+  })()
 
   let response = await dataSource.getFoo()
-  t.false(response.isFromCache)
+  t.deepEqual(response.body, { region: 'eu' })
+
+  dataSource.region = 'us'
+  response = await dataSource.getFoo()
+  t.deepEqual(response.body, { region: 'us' })
   t.false(response.memoized)
-  t.is(response.maxTtl, 10)
-  t.deepEqual(response.body, wanted)
+  t.true(pools.has(usBaseURL))
 
   response = await dataSource.getFoo()
-  t.false(response.isFromCache)
   t.true(response.memoized)
-  t.is(response.maxTtl, 10)
+
+  await dataSource.closePool(usBaseURL)
+  t.false(pools.has(usBaseURL))
+})
+
+test('Should close the own pool and reject further requests', async (t) => {
+  t.plan(4)
+
+  const path = '/'
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(200)
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+  const pool = new Pool(baseURL)
+
+  t.teardown(() => pool.close())
+
+  class DataSource extends HTTPDataSource {
+    getFoo() {
+      return this.get(path)
+    }
+  }
+
+  const dataSource = new DataSource(baseURL)
+  await dataSource.getFoo()
+  await dataSource.close()
+
+  await t.throwsAsync(dataSource.getFoo(), {
+    instanceOf: DataSourceClosedError,
+    message: 'The datasource was closed: /',
+  })
+
+  const sharedPoolDataSource = new DataSource(baseURL, { pool })
+  await sharedPoolDataSource.close()
+
+  t.false(pool.closed)
+  t.false(pool.destroyed)
+})
+
+test('Should expose the statistics of the pool', async (t) => {
+  t.plan(3)
+
+  const path = '/'
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(200)
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    getFoo() {
+      return this.get(path)
+    }
+  })()
+
+  await dataSource.getFoo()
+
+  t.like(dataSource.stats, {
+    pending: 0,
+    queued: 0,
+    running: 0,
+  })
+
+  const agentDataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL, {
+        dispatcher: new Agent(),
+      })
+    }
+  })()
+
+  t.is(agentDataSource.stats, undefined)
+})
+
+test('Should follow redirects and drop the credential headers on cross-origin redirects', async (t) => {
+  t.plan(13)
+
+  const wanted = { name: 'foo' }
+
+  const otherServer = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    t.is(req.headers['authorization'], undefined)
+    t.is(req.headers['proxy-authorization'], undefined)
+    t.is(req.headers['cookie'], undefined)
+    res.writeHead(200, {
+      'content-type': 'application/json',
+    })
+    res.write(JSON.stringify(wanted))
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(otherServer.close.bind(otherServer))
+
+  otherServer.listen()
+
+  const otherBaseURL = getBaseUrlOf(otherServer)
+
+  const server = http.createServer((req, res) => {
+    if (req.url === '/foo') {
+      t.is(req.method, 'POST')
+      res.writeHead(303, {
+        location: '/bar',
+      })
+    } else {
+      t.is(req.method, 'GET')
+      t.is(req.headers['authorization'], 'Bearer secret')
+      t.is(req.headers['proxy-authorization'], 'Basic secret')
+      t.is(req.headers['cookie'], 'session=abc')
+      t.is(req.headers['content-type'], undefined)
+      res.writeHead(301, {
+        location: `${otherBaseURL}/baz?a=1`,
+      })
+    }
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    postFoo() {
+      return this.post('/foo', {
+        maxRedirects: 2,
+        headers: {
+          Authorization: 'Bearer secret',
+          'Proxy-Authorization': 'Basic secret',
+          Cookie: 'session=abc',
+        },
+        body: {
+          name: 'foo',
+        },
+      })
+    }
+  })()
+
+  const response = await dataSource.postFoo()
+
+  t.is(response.statusCode, 200)
+  t.is(response.url, `${otherBaseURL}/baz?a=1`)
   t.deepEqual(response.body, wanted)
+})
 
-  dataSource = new (class extends HTTPDataSource {
+test('Should return the response of a status code accepted by validateStatus', async (t) => {
+  t.plan(5)
+
+  const wanted = { name: 'foo' }
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(req.url === '/missing' ? 404 : 422, {
+      'content-type': 'application/json',
+    })
+    res.write(JSON.stringify(wanted))
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    getFoo(path: string) {
+      return this.get(path, {
+        validateStatus: (statusCode) => statusCode === 404,
+      })
+    }
+  })()
+
+  const response = await dataSource.getFoo('/missing')
+  t.is(response.statusCode, 404)
+  t.deepEqual(response.body, wanted)
+
+  await t.throwsAsync(dataSource.getFoo('/invalid'), {
+    instanceOf: RequestError,
+    message: 'Response code 422 (Unprocessable Entity)',
+  })
+})
+
+test('Should prefer the options of the request over the global requestOptions', async (t) => {
+  t.plan(4)
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(404)
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL, {
+        requestOptions: {
+          validateStatus: () => true,
+        },
+      })
+    }
+    getFoo(path: string, requestOptions?: RequestOptions) {
+      return this.get(path, requestOptions)
+    }
+  })()
+
+  const response = await dataSource.getFoo('/default')
+  t.is(response.statusCode, 404)
+
+  await t.throwsAsync(
+    dataSource.getFoo('/request', {
+      validateStatus: (statusCode) => statusCode === 200,
+    }),
+    { instanceOf: RequestError },
+  )
+})
+
+test('Should not memoize requests when the global requestOptions disable the memoization', async (t) => {
+  t.plan(8)
+
+  const server = http.createServer((req, res) => {
+    t.pass()
+    res.writeHead(200)
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const MemoizeDataSource = class extends HTTPDataSource {
+    constructor(memoize: boolean) {
+      super(baseURL, {
+        requestOptions: {
+          memoize,
+        },
+      })
+    }
+    getFoo() {
+      return this.get('/')
+    }
+    postFoo() {
+      return this.post('/')
+    }
+  }
+
+  const unmemoized = new MemoizeDataSource(false)
+
+  t.false((await unmemoized.getFoo()).memoized)
+  t.false((await unmemoized.getFoo()).memoized)
+
+  // POST requests aren't opted in
+  const memoized = new MemoizeDataSource(true)
+
+  t.false((await memoized.postFoo()).memoized)
+  t.false((await memoized.postFoo()).memoized)
+})
+
+test('Should throw TooManyRedirectsError when maxRedirects is exceeded', async (t) => {
+  t.plan(5)
+
+  const path = '/'
+
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(302, {
+      location: path,
+    })
+    res.end()
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
     constructor() {
       super(baseURL)
     }
     getFoo() {
       return this.get(path, {
-        requestCache: {
-          maxTtl: 10,
-          maxTtlIfError: 20,
+        maxRedirects: 2,
+        retry: {
+          maxRetries: 2,
+          delay: 0,
         },
       })
     }
+    onError(error: Error) {
+      t.true(error instanceof TooManyRedirectsError)
+    }
   })()
 
-  dataSource.initialize(datasSourceConfig)
-
-  response = await dataSource.getFoo()
-  t.true(response.isFromCache)
-  t.false(response.memoized)
-  t.is(response.maxTtl, 10)
-  t.deepEqual(response.body, wanted)
-
-  const cached = JSON.parse(cacheMap.get(baseURL + path)!)
-
-  t.is(cacheMap.size, 2)
-  t.like(cached, {
-    statusCode: 200,
-    trailers: {},
-    opaque: null,
-    headers: {
-      connection: 'keep-alive',
-      'keep-alive': 'timeout=5',
-      'transfer-encoding': 'chunked',
-    },
-    body: wanted,
+  await t.throwsAsync(dataSource.getFoo(), {
+    message: `Maximum of 2 redirects exceeded at ${baseURL}/`,
   })
 })
 
-test('Should respond with stale-if-error cache on origin error', async (t) => {
-  t.plan(12)
-
-  const path = '/'
+test('Should reject requests with PoolExhaustedError when maxQueuedRequests is reached', async (t) => {
+  t.plan(5)
 
   const wanted = { name: 'foo' }
 
-  let reqCount = 0
-
   const server = http.createServer((req, res) => {
     t.is(req.method, 'GET')
-
-    if (reqCount === 0)
-      res.writeHead(200, {
-        'content-type': 'application/json',
-      })
-    else
-      res.writeHead(500, {
-        'content-type': 'application/json',
-      })
-
+    res.writeHead(200, {
+      'content-type': 'application/json',
+    })
     res.write(JSON.stringify(wanted))
     res.end()
     res.socket?.unref()
-    reqCount++
   })
 
   t.teardown(server.close.bind(server))
@@ -1241,91 +4490,114 @@ test('Should respond with stale-if-error cache on origin error', async (t) => {
 
   const baseURL = getBaseUrlOf(server)
 
-  let dataSource = new (class extends HTTPDataSource {
+  const dataSource = new (class extends HTTPDataSource {
     constructor() {
-      super(baseURL)
+      super(baseURL, {
+        maxQueuedRequests: 1,
+        clientOptions: {
+          connections: 1,
+        },
+      })
     }
-    getFoo() {
+    getFoo(path: string) {
       return this.get(path, {
-        requestCache: {
-          maxTtl: 10,
-          maxTtlIfError: 20,
+        retry: {
+          maxRetries: 1,
+          delay: 0,
         },
       })
     }
   })()
 
-  const cacheMap = new Map<string, string>()
-  const datasSourceConfig = {
-    context: {
-      a: 1,
-    },
-    cache: {
-      async delete(key: string) {
-        return cacheMap.delete(key)
-      },
-      async get(key: string) {
-        return cacheMap.get(key)
-      },
-      async set(key: string, value: string) {
-        cacheMap.set(key, value)
-      },
+  const [first, second] = await Promise.all([
+    dataSource.getFoo('/1'),
+    dataSource.getFoo('/2'),
+    t.throwsAsync(dataSource.getFoo('/3'), {
+      instanceOf: PoolExhaustedError,
+      message: `The pool of ${new URL(baseURL).origin} has 1 queued requests: /3`,
+    }),
+  ])
+
+  t.deepEqual(first.body, wanted)
+  t.deepEqual(second.body, wanted)
+})
+
+test('Should throw when maxQueuedRequests is set without limited connections', (t) => {
+  t.plan(1)
+
+  t.throws(
+    () =>
+      new (class extends HTTPDataSource {
+        constructor() {
+          super('http://localhost', {
+            maxQueuedRequests: 1,
+          })
+        }
+      })(),
+    {
+      message: 'maxQueuedRequests requires limited clientOptions.connections',
     },
-  }
+  )
+})
 
-  dataSource.initialize(datasSourceConfig)
+test('Should abort the request when the response body exceeds maxResponseSize', async (t) => {
+  t.plan(4)
 
-  let response = await dataSource.getFoo()
-  t.false(response.isFromCache)
-  t.false(response.memoized)
-  t.is(response.maxTtl, 10)
+  const path = '/'
 
-  t.deepEqual(response.body, wanted)
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'GET')
+    res.writeHead(200, {
+      'content-type': 'application/json',
+    })
+    res.write(JSON.stringify({ name: 'foo' }))
+    res.write(JSON.stringify({ name: 'bar' }))
+    res.end()
+    res.socket?.unref()
+  })
 
-  t.is(cacheMap.size, 2)
+  t.teardown(server.close.bind(server))
 
-  cacheMap.delete(baseURL + path) // ttl is up
+  server.listen()
 
-  dataSource = new (class extends HTTPDataSource {
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
     constructor() {
-      super(baseURL)
+      super(baseURL, {
+        maxResponseSize: 1024,
+      })
     }
     getFoo() {
       return this.get(path, {
-        requestCache: {
-          maxTtl: 10,
-          maxTtlIfError: 20,
-        },
+        maxResponseSize: 20,
       })
     }
+    onError(error: Error) {
+      t.true(error instanceof ResponseTooLargeError)
+      t.is((error as ResponseTooLargeError).maxResponseSize, 20)
+    }
   })()
 
-  dataSource.initialize(datasSourceConfig)
-
-  response = await dataSource.getFoo()
-  t.true(response.isFromCache)
-  t.false(response.memoized)
-  t.is(response.maxTtl, 10)
-
-  t.deepEqual(response.body, wanted)
-
-  t.is(cacheMap.size, 1)
+  await t.throwsAsync(dataSource.getFoo(), {
+    instanceOf: ResponseTooLargeError,
+    message: 'Response body exceeds the maximum size of 20 bytes',
+  })
 })
 
-test('Should not cache POST requests by default', async (t) => {
-  t.plan(6)
+test('Should respond with the body as stream', async (t) => {
+  t.plan(7)
 
   const path = '/'
 
-  const wanted = { name: 'foo' }
-
   const server = http.createServer((req, res) => {
-    t.is(req.method, 'POST')
+    t.is(req.method, 'GET')
     res.writeHead(200, {
-      'content-type': 'application/json',
+      'content-type': 'application/octet-stream',
+      'cache-control': 'max-age=60',
     })
-    res.write(JSON.stringify(wanted))
-    res.end()
+    res.write('foo')
+    res.end('bar')
     res.socket?.unref()
   })
 
@@ -1337,24 +4609,19 @@ test('Should not cache POST requests by default', async (t) => {
 
   const dataSource = new (class extends HTTPDataSource {
     constructor() {
-      super(baseURL)
-    }
-    postFoo() {
-      return this.post(path, {
-        requestCache: {
-          maxTtl: 10,
-          maxTtlIfError: 20,
-        },
+      super(baseURL, {
+        respectCacheControl: true,
       })
     }
+    streamFoo() {
+      return this.stream(path)
+    }
   })()
 
   const cacheMap = new Map<string, string>()
 
   dataSource.initialize({
-    context: {
-      a: 1,
-    },
+    context: {},
     cache: {
       async delete(key: string) {
         return cacheMap.delete(key)
@@ -1362,36 +4629,67 @@ test('Should not cache POST requests by default', async (t) => {
       async get(key: string) {
         return cacheMap.get(key)
       },
-      async set(key: string, value: string, options: KeyValueCacheSetOptions) {
-        t.deepEqual(options, { ttl: 10 })
+      async set(key: string, value: string) {
         cacheMap.set(key, value)
       },
     },
   })
 
-  const response = await dataSource.postFoo()
-  t.false(response.isFromCache)
-  t.false(response.memoized)
-  t.falsy(response.maxTtl)
+  for (let i = 0; i < 2; i++) {
+    const response = await dataSource.streamFoo()
+    t.false(response.memoized)
 
-  t.deepEqual(response.body, wanted)
+    const chunks: Buffer[] = []
+    for await (const chunk of response.body) {
+      chunks.push(chunk)
+    }
+    t.is(Buffer.concat(chunks).toString(), 'foobar')
+  }
 
   t.is(cacheMap.size, 0)
 })
 
-test('Should only cache GET successful responses with the correct status code', async (t) => {
-  t.plan(30)
+test('Should send a FormData body as multipart/form-data and resend it on retries', async (t) => {
+  t.plan(6)
 
   const path = '/'
 
-  const wanted = { name: 'foo' }
-  const server = http.createServer((req, res) => {
-    const queryObject = querystring.parse(req.url?.replace('/?', '')!)
-    t.is(req.method, 'GET')
-    res.writeHead(queryObject['statusCode'] as unknown as number, {
-      'content-type': 'application/json',
-    })
-    res.write(JSON.stringify(wanted))
+  class TestFormData {
+    readonly [Symbol.toStringTag] = 'FormData'
+    private readonly items: Array<[string, string | FormDataFile]> = []
+    append(name: string, value: string | FormDataFile) {
+      this.items.push([name, value])
+    }
+    entries() {
+      return this.items[Symbol.iterator]()
+    }
+  }
+
+  const form = new TestFormData()
+  form.append('name', 'foo')
+  form.append('file', {
+    type: 'text/plain',
+    name: 'foo.txt',
+    arrayBuffer: async () => new Uint8Array(Buffer.from('bar')).buffer,
+  })
+
+  let reqCount = 0
+
+  const server = http.createServer(async (req, res) => {
+    t.is(req.method, 'POST')
+    const boundary = /^multipart\/form-data; boundary=(.+)$/.exec(req.headers['content-type']!)![1]
+    const chunks: Buffer[] = []
+    for await (const chunk of req) {
+      chunks.push(chunk)
+    }
+    t.is(
+      Buffer.concat(chunks).toString(),
+      `--${boundary}\r\nContent-Disposition: form-data; name="name"\r\n\r\nfoo\r\n` +
+        `--${boundary}\r\nContent-Disposition: form-data; name="file"; filename="foo.txt"\r\n` +
+        `Content-Type: text/plain\r\n\r\nbar\r\n` +
+        `--${boundary}--\r\n`,
+    )
+    res.writeHead(++reqCount < 2 ? 503 : 200)
     res.end()
     res.socket?.unref()
   })
@@ -1406,95 +4704,90 @@ test('Should only cache GET successful responses with the correct status code',
     constructor() {
       super(baseURL)
     }
-    getFoo(statusCode: number) {
-      return this.get(path, {
-        query: {
-          statusCode,
-        },
-        requestCache: {
-          maxTtl: 10,
-          maxTtlIfError: 20,
+    upload() {
+      return this.post(path, {
+        body: form,
+        retry: {
+          maxRetries: 1,
+          delay: 0,
         },
       })
     }
   })()
 
-  const cacheMap = new Map<string, string>()
+  const response = await dataSource.upload()
 
-  dataSource.initialize({
-    context: {
-      a: 1,
-    },
-    cache: {
-      async delete(key: string) {
-        return cacheMap.delete(key)
-      },
-      async get(key: string) {
-        return cacheMap.get(key)
-      },
-      async set(key: string, value: string) {
-        cacheMap.set(key, value)
-      },
-    },
-  })
+  t.is(response.statusCode, 200)
+  t.is(reqCount, 2)
+})
 
-  let response = await dataSource.getFoo(200)
-  t.false(response.isFromCache)
-  t.false(response.memoized)
-  t.is(response.maxTtl, 10)
-  t.deepEqual(response.body, wanted)
-  t.is(cacheMap.size, 2)
+test('Should not memoize FormData bodies nor calculate the cache key of unused keys', async (t) => {
+  t.plan(4)
 
-  cacheMap.clear()
+  const path = '/'
 
-  response = await dataSource.getFoo(203)
-  t.false(response.isFromCache)
-  t.false(response.memoized)
-  t.is(response.maxTtl, 10)
-  t.deepEqual(response.body, wanted)
-  t.is(cacheMap.size, 2)
+  class TestFormData {
+    readonly [Symbol.toStringTag] = 'FormData'
+    private readonly items: Array<[string, string]> = []
+    append(name: string, value: string) {
+      this.items.push([name, value])
+    }
+    entries() {
+      return this.items[Symbol.iterator]()
+    }
+  }
 
-  cacheMap.clear()
+  const server = http.createServer((req, res) => {
+    t.is(req.method, 'POST')
+    res.writeHead(200)
+    res.end()
+    res.socket?.unref()
+  })
 
-  // 204 = no content
-  response = await dataSource.getFoo(204)
-  t.false(response.isFromCache)
-  t.false(response.memoized)
-  t.falsy(response.maxTtl)
-  t.falsy(response.body)
-  t.is(cacheMap.size, 0)
+  t.teardown(server.close.bind(server))
 
-  cacheMap.clear()
+  server.listen()
 
-  response = await dataSource.getFoo(300)
-  t.false(response.isFromCache)
-  t.false(response.memoized)
-  t.falsy(response.maxTtl)
-  t.deepEqual(response.body, wanted)
-  t.is(cacheMap.size, 0)
+  const baseURL = getBaseUrlOf(server)
 
-  cacheMap.clear()
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    onCacheKeyCalculation(request: Request) {
+      t.fail('the key of a request which is neither memoized nor cached is calculated')
+      return super.onCacheKeyCalculation(request)
+    }
+    upload(name: string) {
+      const form = new TestFormData()
+      form.append('name', name)
+      return this.post(path, {
+        memoize: true,
+        body: form,
+      })
+    }
+  })()
+
+  let response = await dataSource.upload('foo')
+  t.false(response.memoized)
 
-  response = await dataSource.getFoo(301)
-  t.false(response.isFromCache)
+  response = await dataSource.upload('bar')
   t.false(response.memoized)
-  t.falsy(response.maxTtl)
-  t.deepEqual(response.body, wanted)
-  t.is(cacheMap.size, 0)
 })
 
-test('Should cache POST successful responses if isRequestCacheable allows to do so', async (t) => {
-  t.plan(7)
+test('Should expose the trailers and the raw headers of the response', async (t) => {
+  t.plan(5)
 
-  const path = '/custom/cacheable/post/route'
+  const path = '/'
 
-  const wanted = { name: 'foo' }
   const server = http.createServer((req, res) => {
-    t.is(req.method, 'POST')
-    res.writeHead(200, {
-      'content-type': 'application/json',
-    })
-    res.write(JSON.stringify(wanted))
+    t.is(req.method, 'GET')
+    res.setHeader('set-cookie', ['a=1', 'b=2'])
+    res.setHeader('X-Request-Id', '1')
+    res.setHeader('trailer', 'grpc-status')
+    res.writeHead(200)
+    res.write('foo')
+    res.addTrailers({ 'grpc-status': '0' })
     res.end()
     res.socket?.unref()
   })
@@ -1503,64 +4796,41 @@ test('Should cache POST successful responses if isRequestCacheable allows to do
 
   server.listen()
 
-  const baseURL = `http://localhost:${(server.address() as AddressInfo)?.port}`
+  const baseURL = getBaseUrlOf(server)
 
   const dataSource = new (class extends HTTPDataSource {
     constructor() {
       super(baseURL)
     }
-    protected isRequestCacheable(request: Request): boolean {
-      return request.method === 'GET' || (request.method === 'POST' && request.path === path)
-    }
-    postFoo() {
-      return this.post(path, {
-        body: wanted,
-        requestCache: {
-          maxTtl: 10,
-          maxTtlIfError: 20,
-        },
-      })
+    getFoo() {
+      return this.get(path)
     }
   })()
 
-  const cacheMap = new Map<string, string>()
-
-  dataSource.initialize({
-    context: {
-      a: 1,
-    },
-    cache: {
-      async delete(key: string) {
-        return cacheMap.delete(key)
-      },
-      async get(key: string) {
-        return cacheMap.get(key)
-      },
-      async set(key: string, value: string) {
-        cacheMap.set(key, value)
-      },
-    },
-  })
-
-  let response = await dataSource.postFoo()
-  t.deepEqual(response.body, wanted)
-  t.false(response.memoized)
-  t.false(response.isFromCache)
+  const response = await dataSource.getFoo()
 
-  response = await dataSource.postFoo()
-  t.deepEqual(response.body, wanted)
-  t.false(response.memoized)
-  t.true(response.isFromCache)
+  t.deepEqual(response.headers['set-cookie'], ['a=1', 'b=2'])
+  t.deepEqual(
+    response.rawHeaders?.filter((_, i, rawHeaders) => rawHeaders[i - 1] === 'set-cookie'),
+    ['a=1', 'b=2'],
+  )
+  t.deepEqual(
+    response.rawHeaders?.filter((_, i, rawHeaders) => rawHeaders[i - 1] === 'X-Request-Id'),
+    ['1'],
+  )
+  t.deepEqual(response.trailers, { 'grpc-status': '0' })
 })
 
-test.serial('Global maxAge should be used when no maxAge was set or similar.', async (t) => {
-  const path = '/'
-
-  const clock = FakeTimers.install()
-  t.teardown(clock.uninstall.bind(clock))
+test('Should store the cookies of responses in the cookie jar and send them', async (t) => {
+  t.plan(4)
 
   const server = http.createServer((req, res) => {
     t.is(req.method, 'GET')
+    if (req.url === '/login') {
+      res.setHeader('set-cookie', 'session=abc; Path=/; HttpOnly')
+    } else {
+      t.is(req.headers['cookie'], 'foo=bar; session=abc')
+    }
     res.writeHead(200)
     res.end()
     res.socket?.unref()
@@ -1572,42 +4842,51 @@ test.serial('Global maxAge should be used when no maxAge was set or similar.', a
 
   const baseURL = getBaseUrlOf(server)
 
-  let testResponse: Pick<Response<any>, 'memoized'> = {
-    memoized: false,
-  }
-  const maxAge = 10000
+  const cookies = new Map<string, string>()
+
   const dataSource = new (class extends HTTPDataSource {
     constructor() {
       super(baseURL, {
-        lru: {
-          maxAge: maxAge,
+        cookieJar: {
+          async getCookieString(url: string) {
+            return cookies.get(new URL(url).origin) ?? ''
+          },
+          async setCookie(cookie: string, url: string) {
+            t.is(url, `${baseURL}/login`)
+            cookies.set(new URL(url).origin, cookie.split(';')[0])
+          },
         },
       })
     }
-    getFoo() {
-      return this.get(path)
+    login() {
+      return this.get('/login')
     }
-    onResponse(_: Request, response: Response<any>) {
-      testResponse = response
-      return response
+    getFoo() {
+      return this.get('/foo', {
+        headers: {
+          cookie: 'foo=bar',
+        },
+      })
     }
   })()
 
+  await dataSource.login()
   await dataSource.getFoo()
-  t.is(testResponse.memoized, false)
-  await dataSource.getFoo()
-  t.is(testResponse.memoized, true)
-  clock.tick(maxAge)
-  await dataSource.getFoo()
-  t.is(testResponse.memoized, false)
 })
 
-test('Response is not cached due to origin error', async (t) => {
+test('Should redact sensitive headers and body fields of errors', async (t) => {
+  t.plan(8)
+
   const path = '/'
 
   const server = http.createServer((req, res) => {
-    t.is(req.method, 'GET')
-    res.writeHead(500)
+    t.is(req.method, 'POST')
+    t.is(req.headers['authorization'], 'Bearer secret')
+    res.writeHead(500, {
+      'content-type': 'application/json',
+      'set-cookie': 'session=abc',
+    })
+    res.write(JSON.stringify({ user: { name: 'foo', password: 'bar' } }))
     res.end()
     res.socket?.unref()
   })
@@ -1620,65 +4899,116 @@ test('Response is not cached due to origin error', async (t) => {
 
   const dataSource = new (class extends HTTPDataSource {
     constructor() {
-      super(baseURL)
+      super(baseURL, {
+        redact: {
+          bodyPaths: ['user.password', 'items.*.token'],
+        },
+      })
     }
-    getFoo() {
-      return this.get(path, {
-        requestCache: {
-          maxTtl: 10,
-          maxTtlIfError: 20,
+    postFoo() {
+      return this.post(path, {
+        headers: {
+          Authorization: 'Bearer secret',
+        },
+        body: {
+          user: { name: 'foo', password: 'bar' },
+          items: [{ token: 'a' }, { token: 'b' }],
         },
       })
     }
+    onError(error: Error, request: Request) {
+      t.is(request.headers['Authorization'], '***')
+      t.deepEqual(JSON.parse(request.body as string), {
+        user: { name: 'foo', password: '***' },
+        items: [{ token: '***' }, { token: '***' }],
+      })
+      if (error instanceof RequestError) {
+        t.is(error.request, request)
+        t.is(error.response?.headers['set-cookie'] as unknown, '***')
+        t.deepEqual(error.body, { user: { name: 'foo', password: '***' } })
+      }
+    }
   })()
 
-  const cacheMap = new Map<string, string>()
+  await t.throwsAsync(dataSource.postFoo(), {
+    instanceOf: RequestError,
+    message: 'Response code 500 (Internal Server Error)',
+  })
+})
 
-  dataSource.initialize({
-    context: {
-      a: 1,
-    },
-    cache: {
-      async delete(key: string) {
-        return cacheMap.delete(key)
-      },
-      async get(key: string) {
-        return cacheMap.get(key)
-      },
-      async set(key: string, value: string) {
-        console.log(key)
+test('Should execute a batch of requests with limited concurrency', async (t) => {
+  let inFlight = 0
+  let maxInFlight = 0
 
-        cacheMap.set(key, value)
-      },
-    },
+  const server = http.createServer((req, res) => {
+    inFlight++
+    maxInFlight = Math.max(maxInFlight, inFlight)
+    setTimeout(() => {
+      inFlight--
+      res.writeHead(req.url === '/fail' ? 500 : 200, {
+        'content-type': 'application/json',
+      })
+      res.write(JSON.stringify({ path: req.url }))
+      res.end()
+      res.socket?.unref()
+    }, 10)
   })
 
-  await t.throwsAsync(
-    dataSource.getFoo(),
-    {
-      message: 'Response code 500 (Internal Server Error)',
-      code: 500,
-    },
-    'message',
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL)
+    }
+    getAll(paths: string[]) {
+      return this.all<{ path: string }>(
+        paths.map((path) => ({ method: 'GET' as const, path })),
+        { concurrency: 2 },
+      )
+    }
+    getAllSettled(paths: string[]) {
+      return this.all<{ path: string }>(
+        paths.map((path) => ({ method: 'GET' as const, path })),
+        { concurrency: 2, settle: true },
+      )
+    }
+  })()
+
+  const responses = await dataSource.getAll(['/a', '/b', '/c', '/d', '/e'])
+
+  t.deepEqual(
+    responses.map((response) => response.body.path),
+    ['/a', '/b', '/c', '/d', '/e'],
   )
+  t.is(maxInFlight, 2)
 
-  t.is(cacheMap.size, 0)
+  await t.throwsAsync(dataSource.getAll(['/fail', '/f']), {
+    message: 'Response code 500 (Internal Server Error)',
+  })
+
+  const results = await dataSource.getAllSettled(['/g', '/fail', '/h'])
+
+  t.deepEqual(
+    results.map((result) => result.status),
+    ['fulfilled', 'rejected', 'fulfilled'],
+  )
 })
 
-test('Should be able to pass custom Undici Pool', async (t) => {
-  t.plan(2)
+test('Should collect the timings of requests', async (t) => {
+  t.plan(9)
 
   const path = '/'
 
-  const wanted = { name: 'foo' }
+  let reqCount = 0
 
   const server = http.createServer((req, res) => {
     t.is(req.method, 'GET')
-    res.writeHead(200, {
-      'content-type': 'application/json',
-    })
-    res.write(JSON.stringify(wanted))
-    res.end()
+    res.writeHead(++reqCount < 2 ? 503 : 200)
+    res.end('foo')
     res.socket?.unref()
   })
 
@@ -1687,22 +5017,82 @@ test('Should be able to pass custom Undici Pool', async (t) => {
   server.listen()
 
   const baseURL = getBaseUrlOf(server)
-  const pool = new Pool(baseURL)
 
   const dataSource = new (class extends HTTPDataSource {
     constructor() {
       super(baseURL, {
-        pool,
+        collectTimings: true,
       })
     }
     getFoo() {
+      return this.get(path, {
+        retry: {
+          maxRetries: 1,
+          delay: 0,
+        },
+      })
+    }
+  })()
+
+  let response = await dataSource.getFoo()
+
+  t.like(response.timings, {
+    retryCount: 1,
+    fromCache: false,
+  })
+  t.true(response.timings!.total > 0)
+  t.true(response.timings!.ttfb! >= 0)
+  t.true(response.timings!.download! >= 0)
+  t.true(response.timings!.total >= response.timings!.ttfb! + response.timings!.download!)
+
+  response = await dataSource.getFoo()
+
+  t.true(response.memoized)
+  t.deepEqual(response.timings, {
+    total: 0,
+    retryCount: 0,
+    fromCache: true,
+  })
+})
+
+test('Should measure the time a request was queued by the pool', async (t) => {
+  t.plan(4)
+
+  const server = http.createServer((req, res) => {
+    setTimeout(() => {
+      res.writeHead(200)
+      res.end('foo')
+      res.socket?.unref()
+    }, 50)
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL, {
+        collectTimings: true,
+        clientOptions: {
+          connections: 1,
+        },
+      })
+    }
+    getFoo(path: string) {
       return this.get(path)
     }
   })()
 
-  const response = await dataSource.getFoo()
+  const [first, second] = await Promise.all([dataSource.getFoo('/1'), dataSource.getFoo('/2')])
 
-  t.deepEqual(response.body, wanted)
+  t.true(first.timings!.queued! >= 0)
+  t.true(first.timings!.connect! >= 0)
+  t.true(first.timings!.ttfb! >= 40)
+  // the second request waits until the response of the first request was received
+  t.true(second.timings!.queued! >= 40)
 })
 
 test('Should be merge headers', async (t) => {
@@ -1815,6 +5205,64 @@ test('Should be able to decode gzip compression', async (t) => {
   t.deepEqual(response.body, { name: 'foo' })
 })
 
+test('Should pass the compressed body when decompression is disabled or the limit is exceeded', async (t) => {
+  t.plan(3)
+
+  const path = '/'
+
+  const wanted = { name: 'foo'.repeat(100) }
+
+  const server = http.createServer((_req, res) => {
+    res.writeHead(200, {
+      'content-encoding': 'gzip',
+      'content-type': 'application/json',
+    })
+    res.end(gzipSync(JSON.stringify(wanted)))
+    res.socket?.unref()
+  })
+
+  t.teardown(server.close.bind(server))
+
+  server.listen()
+
+  const baseURL = getBaseUrlOf(server)
+
+  const dataSource = new (class extends HTTPDataSource {
+    constructor() {
+      super(baseURL, {
+        decompress: false,
+      })
+    }
+    getRaw() {
+      return this.get<string>(path, {
+        responseType: 'text',
+        memoize: false,
+        maxResponseSize: 10,
+      })
+    }
+    getFoo() {
+      return this.get(path, {
+        memoize: false,
+        decompress: true,
+        maxCompressedResponseSize: 10,
+      })
+    }
+  })()
+
+  await t.throwsAsync(dataSource.getRaw(), {
+    instanceOf: ResponseTooLargeError,
+    message: 'Response body exceeds the maximum size of 10 bytes',
+  })
+
+  const response = await dataSource.get<Buffer>(path, { responseType: 'arraybuffer' })
+  t.deepEqual(JSON.parse(gunzipSync(response.body).toString()), wanted)
+
+  await t.throwsAsync(dataSource.getFoo(), {
+    instanceOf: ResponseTooLargeError,
+    message: 'Compressed response body exceeds the maximum size of 10 bytes',
+  })
+})
+
 test('Should be able to decode deflate compression', async (t) => {
   t.plan(4)
 